@@ -0,0 +1,81 @@
+// Package backoff 提供重试之间等待时间的计算策略，客户端重试和服务发现刷新共用
+package backoff
+
+import (
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// Backoff computes the waits between consecutive attempts.
+// 实现是有状态的，不是并发安全的，每个重试循环应当使用自己的实例
+type Backoff interface {
+	// Next returns the wait before the next attempt
+	Next() time.Duration
+	// Reset restarts the sequence, e.g. after a success
+	Reset()
+}
+
+// Exponential doubles the wait after each attempt: min, 2*min, 4*min, ... up to max.
+type Exponential struct {
+	min, max time.Duration
+	next     time.Duration
+}
+
+// NewExponential returns an Exponential starting at min, max <= 0 means no limit.
+func NewExponential(min, max time.Duration) *Exponential {
+	return &Exponential{min: min, max: max, next: min}
+}
+
+func (b *Exponential) Next() time.Duration {
+	d := b.next
+	if b.max > 0 && d >= b.max {
+		return b.max
+	}
+	if d > math.MaxInt64/2 {
+		b.next = math.MaxInt64
+	} else {
+		b.next = d * 2
+	}
+	return d
+}
+
+func (b *Exponential) Reset() {
+	b.next = b.min
+}
+
+// Constant waits the same interval before each attempt.
+type Constant struct {
+	interval time.Duration
+}
+
+func NewConstant(interval time.Duration) *Constant {
+	return &Constant{interval: interval}
+}
+
+func (b *Constant) Next() time.Duration {
+	return b.interval
+}
+
+func (b *Constant) Reset() {}
+
+// Jittered randomizes the waits of another Backoff, so that clients failed at the same time
+// don't retry at the same time. Each wait d becomes a random value in [d*(1-factor), d].
+type Jittered struct {
+	b      Backoff
+	factor float64
+}
+
+// NewJittered returns a Jittered wrapping b, factor is clamped to [0, 1].
+func NewJittered(b Backoff, factor float64) *Jittered {
+	return &Jittered{b: b, factor: min(max(factor, 0), 1)}
+}
+
+func (b *Jittered) Next() time.Duration {
+	d := b.b.Next()
+	return d - time.Duration(rand.Float64()*b.factor*float64(d))
+}
+
+func (b *Jittered) Reset() {
+	b.b.Reset()
+}
@@ -0,0 +1,53 @@
+package backoff
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func _assert(condition bool, msg string, v ...any) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+func TestExponential(t *testing.T) {
+	b := NewExponential(time.Second, 5*time.Second)
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, w := range want {
+		d := b.Next()
+		_assert(d == w, "wait %d: expect %s, got %s", i, w, d)
+	}
+	b.Reset()
+	_assert(b.Next() == time.Second, "expect the sequence to restart after Reset")
+
+	// 没有上限时一直翻倍，不会溢出
+	b = NewExponential(time.Second, 0)
+	for range 100 {
+		_assert(b.Next() > 0, "wait should not overflow")
+	}
+}
+
+func TestConstant(t *testing.T) {
+	b := NewConstant(time.Second)
+	for range 3 {
+		_assert(b.Next() == time.Second, "expect a constant wait")
+	}
+	b.Reset()
+	_assert(b.Next() == time.Second, "expect a constant wait after Reset")
+}
+
+func TestJittered(t *testing.T) {
+	b := NewJittered(NewExponential(time.Second, 0), 0.5)
+	for i := range 5 {
+		d, base := b.Next(), time.Second<<i
+		_assert(d >= base/2 && d <= base, "wait %d: expect within [%s, %s], got %s", i, base/2, base, d)
+	}
+	b.Reset()
+	d := b.Next()
+	_assert(d >= time.Second/2 && d <= time.Second, "expect the wrapped sequence to restart after Reset, got %s", d)
+
+	b = NewJittered(NewConstant(time.Second), 0)
+	_assert(b.Next() == time.Second, "factor 0 should not change the wait")
+}
@@ -10,8 +10,10 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"reflect"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"aurerpc/codec"
@@ -21,14 +23,25 @@ import (
 
 type Call struct {
 	Seq           uint64
-	ServiceMethod string     // format: "<service>.<method>"
-	Args          any        // arguments to the function
-	Reply         any        // reply from the function
-	Error         error      // if err occurred, it will be placed here
-	Done          chan *Call // used to notify caller that call is complete
+	ServiceMethod string        // format: "<service>.<method>"
+	Args          any           // arguments to the function
+	Reply         any           // reply from the function
+	Error         error         // if err occurred, it will be placed here
+	Done          chan *Call    // used to notify caller that call is complete
+	Duration      time.Duration // round-trip time from sending the request to receiving the response
+
+	start    time.Time       // time when the request is sent
+	ctx      context.Context // context of the call, the values of the propagated keys are sent as metadata
+	finished chan struct{}   // closed once the call is complete, only for calls made by GoCtx
 }
 
 func (call *Call) done() {
+	if !call.start.IsZero() {
+		call.Duration = time.Since(call.start)
+	}
+	if call.finished != nil {
+		close(call.finished)
+	}
 	call.Done <- call
 }
 
@@ -57,6 +70,16 @@ type Client struct {
 	pending  map[uint64]*Call
 	closing  bool // user has called Close
 	shutdown bool // server has told us to stop
+
+	receiveOnce sync.Once // starts the receive goroutine exactly once
+
+	headerHook func(h *codec.Header) // protected by sending, see SetHeaderHook
+
+	// 以下字段用于断线重连，只有通过 dialTimeout 创建的 Client 才会设置 dial
+	network, address string
+	dial             newClientFunc
+	nextRedial       time.Time     // protected by sending, no reconnect is tried before it
+	redialBackoff    time.Duration // protected by sending
 }
 
 var _ io.Closer = (*Client)(nil)
@@ -70,21 +93,49 @@ func NewClient(conn net.Conn, opt *server.Option) (*Client, error) {
 		log.Println("rpc client: codec error:", err)
 		return nil, err
 	}
+	if err := handshake(conn, opt); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	rwc, err := codec.WrapCompress(conn, opt.CompressType)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	// 与服务端一样，根据协议版本决定是否分帧
+	f = codec.CodecFunc(opt.CodecType, opt.ProtocolVersion)
+	cc := f(rwc)
+	if opt.Checksum {
+		if err := codec.EnableChecksum(cc); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return newClientCodec(cc, opt), nil
+}
+
+// handshake sends options to the server and waits for the echoed options,
+// a *server.HandshakeError is returned if the server rejects the connection.
+func handshake(conn net.Conn, opt *server.Option) error {
 	// send options with server
 	// conn表示一个客户端和服务端的连接
 	// 创建一个写入conn的编码器，opt是客户端在连接RPC时希望使用的配置
 	if err := json.NewEncoder(conn).Encode(opt); err != nil {
 		log.Println("rpc client: send options error: ", err)
-		_ = conn.Close()
-		return nil, err
+		return err
 	}
 
-	if err := json.NewDecoder(conn).Decode(opt); err != nil {
+	// 服务端回复 opt 或者错误帧，回复的 opt 直接写入 opt 中
+	reply := server.HandshakeReply{Option: opt}
+	if err := json.NewDecoder(conn).Decode(&reply); err != nil {
 		log.Println("rpc client: receive options error: ", err)
-		_ = conn.Close()
-		return nil, err
+		return err
+	}
+	if reply.HandshakeError != nil {
+		log.Println("rpc client: handshake error: ", reply.HandshakeError)
+		return reply.HandshakeError
 	}
-	return newClientCodec(f(conn), opt), nil
+	return nil
 }
 
 func newClientCodec(cc codec.Codec, opt *server.Option) *Client {
@@ -94,10 +145,20 @@ func newClientCodec(cc codec.Codec, opt *server.Option) *Client {
 		seq:     1, // starts with 1, 0 means invalid call.
 		pending: make(map[uint64]*Call),
 	}
-	go client.receive()
+	// LazyReceive 模式下，直到第一次发送请求才启动接收协程，避免未使用的 Client 占用协程
+	if !opt.LazyReceive {
+		client.startReceive()
+	}
 	return client
 }
 
+// startReceive starts the receive goroutine if it is not running yet
+func (client *Client) startReceive() {
+	client.receiveOnce.Do(func() {
+		go client.receive()
+	})
+}
+
 func (client *Client) Close() error {
 	client.mu.Lock()
 	defer client.mu.Unlock()
@@ -121,12 +182,31 @@ func (client *Client) registerCall(call *Call) (uint64, error) {
 	if client.closing || client.shutdown {
 		return 0, ErrShutdown
 	}
+	// 服务端一直不响应时，pending 会无限增长，超过上限时直接拒绝新的调用
+	if limit := client.opt.MaxPendingCalls; limit > 0 && len(client.pending) >= limit {
+		return 0, ErrTooManyPendingCalls
+	}
 	call.Seq = client.seq           // 分配序列号
 	client.pending[call.Seq] = call // 将调用注册到待处理 map 中
 	client.seq++                    // 客户端序列号++
 	return call.Seq, nil
 }
 
+// SetHeaderHook 设置请求头的钩子，每个请求写入连接之前调用，可以修改请求头，例如添加签名到 Metadata 中
+// 钩子在 sending 锁中调用，只有对 Metadata 的修改会生效，ServiceMethod、Seq、Error、Oneway 和 Deadline 会被恢复
+func (client *Client) SetHeaderHook(hook func(h *codec.Header)) {
+	client.sending.Lock()
+	defer client.sending.Unlock()
+	client.headerHook = hook
+}
+
+// Pending returns the number of calls waiting for a response
+func (client *Client) Pending() int {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return len(client.pending)
+}
+
 // removeCall 根据序列号取出等待处理的调用 Call
 func (client *Client) removeCall(seq uint64) *Call {
 	client.mu.Lock()
@@ -148,6 +228,61 @@ func (client *Client) terminateCalls(err error) {
 		call.Error = err
 		call.done()
 	}
+	// 重连后 pending 中不能留下已经结束的调用
+	client.pending = make(map[uint64]*Call)
+}
+
+const (
+	// defaultReconnectBackoff is the wait after the first failed reconnect when Option.ReconnectBackoff is 0
+	defaultReconnectBackoff = 100 * time.Millisecond
+	// maxReconnectBackoff is the upper limit of the wait between failed reconnects
+	maxReconnectBackoff = 30 * time.Second
+)
+
+// reconnect re-dials the server if the connection has dropped and Option.Reconnect is set,
+// the calls pending at drop time have already failed, only new calls use the new connection.
+// must be called with sending held.
+func (client *Client) reconnect() {
+	client.mu.Lock()
+	shouldRedial := client.shutdown && !client.closing
+	client.mu.Unlock()
+	if !shouldRedial || !client.opt.Reconnect || client.dial == nil || time.Now().Before(client.nextRedial) {
+		return
+	}
+
+	// 新建的 Client 只用来完成握手，不启动它的接收协程，之后接管它的 codec
+	opt := *client.opt
+	opt.LazyReceive = true
+	nc, err := dialTimeout(client.dial, client.network, client.address, &opt)
+	if err != nil {
+		// 重连失败后退避一段时间，期间的调用直接返回 ErrShutdown
+		// 退避时间不能为 0，否则服务端不可用期间每次调用都会同步重连
+		base := client.opt.ReconnectBackoff
+		if base <= 0 {
+			base = defaultReconnectBackoff
+		}
+		limit := max(maxReconnectBackoff, base)
+		client.redialBackoff = min(max(client.redialBackoff*2, base), limit)
+		client.nextRedial = time.Now().Add(client.redialBackoff)
+		log.Printf("rpc client: reconnect to %s failed, retry after %s: %v\n", client.address, client.redialBackoff, err)
+		return
+	}
+	client.redialBackoff, client.nextRedial = 0, time.Time{}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.closing {
+		_ = nc.cc.Close()
+		return
+	}
+	// shutdown 为 true 时原来的接收协程已经退出，可以安全地关闭并替换 codec
+	_ = client.cc.Close()
+	client.cc = nc.cc
+	client.shutdown = false
+	client.receiveOnce = sync.Once{}
+	if !client.opt.LazyReceive {
+		client.startReceive()
+	}
 }
 
 func (client *Client) receive() {
@@ -171,7 +306,11 @@ func (client *Client) receive() {
 		default:
 			err = client.cc.ReadBody(call.Reply)
 			if err != nil {
-				call.Error = errors.New("reading body err " + err.Error())
+				call.Error = &ReplyTypeError{
+					ServiceMethod: call.ServiceMethod,
+					ReplyType:     reflect.TypeOf(call.Reply),
+					Err:           err,
+				}
 			}
 			call.done()
 		}
@@ -185,31 +324,98 @@ func (client *Client) send(call *Call) {
 	client.sending.Lock()
 	defer client.sending.Unlock()
 
+	// the connection may have dropped, try to re-dial it if enabled
+	client.reconnect()
+
 	// register this call.
 	seq, err := client.registerCall(call)
 	if err != nil {
 		call.Error = err
+		if errors.Is(err, ErrShutdown) {
+			// 连接在发送前已经断开，请求没有发出
+			call.Error = &notSentError{err}
+		}
 		call.done()
 		return
 	}
 
+	// the response can only be received once the receive goroutine is running
+	client.startReceive()
+
 	// prepare request header
 	client.header.ServiceMethod = call.ServiceMethod
 	client.header.Seq = seq
 	client.header.Error = ""
+	client.header.Oneway = false
+	client.header.Deadline = 0
+	// 把调用的截止时间告诉服务端，客户端放弃等待后服务端也不必继续处理
+	if deadline, ok := call.ctx.Deadline(); ok {
+		client.header.Deadline = deadline.UnixNano()
+	}
+	client.header.Metadata = server.ContextMetadata(call.ctx)
+	if client.headerHook != nil {
+		deadline := client.header.Deadline
+		client.headerHook(&client.header)
+		// hook 只能修改 Metadata，其他字段决定请求如何被处理和回复，恢复为原来的值，保证请求能和 Call 对应上
+		client.header.ServiceMethod = call.ServiceMethod
+		client.header.Seq = seq
+		client.header.Error = ""
+		client.header.Oneway = false
+		client.header.Deadline = deadline
+	}
 
 	// encode and send the request
+	call.start = time.Now()
 	if err := client.cc.Write(&client.header, call.Args); err != nil {
 		call := client.removeCall(seq)
 		// call may be nil, it usually means that Write partially failed,
 		// client has received the response and handled
 		if call != nil {
 			call.Error = err
+			// 发送时连接被重置，服务端收不到完整的请求
+			if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+				call.Error = &notSentError{err}
+			}
 			call.done()
 		}
 	}
 }
 
+// Notify sends a oneway request and returns once it has been written,
+// the server invokes the method but sends no reply, so errors of the method are not reported.
+// 请求不会注册到 pending 中，也不受 MaxPendingCalls 限制
+func (client *Client) Notify(ctx context.Context, serviceMethod string, args any) error {
+	client.sending.Lock()
+	defer client.sending.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	client.reconnect()
+
+	client.mu.Lock()
+	if client.closing || client.shutdown {
+		client.mu.Unlock()
+		return ErrShutdown
+	}
+	seq := client.seq
+	client.seq++
+	client.mu.Unlock()
+
+	client.header.ServiceMethod = serviceMethod
+	client.header.Seq = seq
+	client.header.Error = ""
+	client.header.Oneway = true
+	client.header.Deadline = 0
+	client.header.Metadata = server.ContextMetadata(ctx)
+	if client.headerHook != nil {
+		client.headerHook(&client.header)
+		client.header.ServiceMethod = serviceMethod
+		client.header.Seq = seq
+		client.header.Oneway = true
+	}
+	return client.cc.Write(&client.header, args)
+}
+
 // Go 和 Call 是客户端暴露给用户的两个 RPC 服务调用接口
 // Go 是异步调用，而 Call 是同步调用
 // Call 是对 Go 的封装，阻塞 call.Done，等待响应返回
@@ -219,19 +425,56 @@ func (client *Client) send(call *Call) {
 // If done is nil, Go will allocate a new channel.
 // If non-nil, done must be buffered or Go will deliberately crash.
 func (client *Client) Go(serviceMethod string, args, reply any, done chan *Call) *Call {
+	return client.goContext(context.Background(), serviceMethod, args, reply, done)
+}
+
+// GoCtx is like Go, but the call is completed with the error of ctx once ctx is done,
+// the response arriving later is discarded. The values of the keys registered by
+// PropagateContextKeys are taken from ctx and sent along with the request.
+// 调用方不需要读取 done，ctx 结束时调用也会从 pending 中移除
+func (client *Client) GoCtx(ctx context.Context, serviceMethod string, args, reply any, done chan *Call) *Call {
+	if ctx.Done() == nil {
+		return client.goContext(ctx, serviceMethod, args, reply, done)
+	}
+	call := newCall(ctx, serviceMethod, args, reply, done)
+	call.finished = make(chan struct{})
+	client.send(call)
+	go func() {
+		select {
+		case <-call.finished:
+		case <-ctx.Done():
+			// 先从 pending 中移除成功的一方负责完成调用
+			if client.removeCall(call.Seq) != nil {
+				call.Error = fmt.Errorf("rpc client: call failed: %w", ctx.Err())
+				call.done()
+			}
+		}
+	}()
+	return call
+}
+
+// goContext is like Go, the values of the keys registered by PropagateContextKeys
+// are taken from ctx and sent along with the request.
+func (client *Client) goContext(ctx context.Context, serviceMethod string, args, reply any, done chan *Call) *Call {
+	call := newCall(ctx, serviceMethod, args, reply, done)
+	client.send(call)
+	return call
+}
+
+// newCall returns a call which is not sent yet, a nil done is replaced by a new channel
+func newCall(ctx context.Context, serviceMethod string, args, reply any, done chan *Call) *Call {
 	if done == nil {
 		done = make(chan *Call, 10)
 	} else if cap(done) == 0 {
 		log.Panic("rpc client: done channel is unbuffered")
 	}
-	call := &Call{
+	return &Call{
 		ServiceMethod: serviceMethod,
 		Args:          args,
 		Reply:         reply,
 		Done:          done,
+		ctx:           ctx,
 	}
-	client.send(call)
-	return call
 }
 
 // Call invokes the named function, waits for it to complete,
@@ -241,16 +484,35 @@ func (client *Client) Go(serviceMethod string, args, reply any, done chan *Call)
 //
 // 添加超时处理机制，使用 context 包实现，控制权交给用户
 func (client *Client) Call(ctx context.Context, serviceMethod string, args, reply any) error {
-	call := client.Go(serviceMethod, args, reply, make(chan *Call, 1))
+	_, err := client.CallTimed(ctx, serviceMethod, args, reply)
+	return err
+}
+
+// CallTimed is like Call, but also returns the round-trip time of the call,
+// measured from sending the request to receiving the response.
+func (client *Client) CallTimed(ctx context.Context, serviceMethod string, args, reply any) (time.Duration, error) {
+	call := client.goContext(ctx, serviceMethod, args, reply, make(chan *Call, 1))
 	select {
 	case <-ctx.Done():
 		client.removeCall(call.Seq)
-		return errors.New("rpc client: call failed: " + ctx.Err().Error())
+		return time.Since(call.start), errors.New("rpc client: call failed: " + ctx.Err().Error())
 	case result := <-call.Done:
-		return result.Error
+		return result.Duration, result.Error
 	}
 }
 
+// RegisterGobType records the concrete type of v for gob encoding,
+// it must be registered on both client and server, see server.RegisterGobType.
+func RegisterGobType(v any) {
+	server.RegisterGobType(v)
+}
+
+// PropagateContextKeys registers context keys whose values are sent to the server
+// along with each call made by Call, see server.PropagateContextKeys.
+func PropagateContextKeys(keys ...any) {
+	server.PropagateContextKeys(keys...)
+}
+
 type clientResult struct {
 	client *Client
 	err    error
@@ -280,22 +542,28 @@ func dialTimeout(f newClientFunc, network, address string,
 
 	// 2.使用子协程执行 NewClient，执行完成后则通过信道 ch 发送结果
 	// 如果 time.After() 信道先接收到消息，则说明 NewClient 执行超时，返回错误
+	// 握手时服务端回复的 opt 会写入 opt 中，提前读取超时时间，避免数据竞争
+	connectTimeout := opt.ConnectTimeout
 	ch := make(chan clientResult)
 	go func() {
 		client, err := f(conn, opt)
+		if client != nil {
+			// 记录连接的地址，断线后用来重连
+			client.network, client.address, client.dial = network, address, f
+		}
 		ch <- clientResult{client: client, err: err}
 	}()
 
 	// 如果连接超时时间为0，表示无限制，等待客户端创建完成后返回
-	if opt.ConnectTimeout == 0 {
+	if connectTimeout == 0 {
 		result := <-ch
 		return result.client, result.err
 	}
 
 	// 超时时间不为0，使用 select 监听多个通道上的事件
 	select {
-	case <-time.After(opt.ConnectTimeout):
-		return nil, fmt.Errorf("rpc client: connect timeout: expect within %s", opt.ConnectTimeout)
+	case <-time.After(connectTimeout):
+		return nil, fmt.Errorf("rpc client: connect timeout: expect within %s", connectTimeout)
 	case result := <-ch:
 		return result.client, result.err
 	}
@@ -322,15 +590,21 @@ func dialWithoutTimeout(f newClientFunc, network, address string,
 }
 
 func parseOptions(opts ...*server.Option) (*server.Option, error) {
+	// 返回副本：握手时服务端回复的 Option 会写入其中，不能修改全局的 DefaultOption 或调用方的 Option
 	// if opts is nil or pass nil as parameter
 	if len(opts) == 0 || opts[0] == nil {
-		return server.DefaultOption, nil
+		o := *server.DefaultOption
+		return &o, nil
 	}
 	if len(opts) != 1 {
 		return nil, errors.New("number of options is more than 1")
 	}
-	opt := opts[0]
+	o := *opts[0]
+	opt := &o
 	opt.MagicNumber = server.DefaultOption.MagicNumber
+	if opt.ProtocolVersion == 0 {
+		opt.ProtocolVersion = server.DefaultOption.ProtocolVersion
+	}
 	if opt.CodecType == "" {
 		opt.CodecType = server.DefaultOption.CodecType
 	}
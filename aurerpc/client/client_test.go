@@ -2,15 +2,30 @@ package client
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
 	"fmt"
+	"math/big"
 	"net"
 	"os"
+	"reflect"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"aurerpc/codec"
+	"aurerpc/discovery"
 	"aurerpc/server"
+
+	"github.com/vmihailenco/msgpack/v5"
 )
 
 func _assert(condition bool, msg string, v ...any) {
@@ -47,6 +62,11 @@ func (b Bar) Timeout(argv int, reply *int) error {
 	return nil
 }
 
+func (b Bar) Double(argv int, reply *int) error {
+	*reply = argv * 2
+	return nil
+}
+
 func startServer(addr chan string) {
 	var b Bar
 	_ = server.Register(&b)
@@ -55,12 +75,51 @@ func startServer(addr chan string) {
 	server.Accept(l)
 }
 
+// startTestServer starts a new server serving rcvrs and returns its address
+func startTestServer(t *testing.T, rcvrs ...any) (*server.Server, string) {
+	t.Helper()
+	s := server.NewServer()
+	for _, rcvr := range rcvrs {
+		if err := s.Register(rcvr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go s.Accept(l)
+	<-s.Ready()
+	return s, l.Addr().String()
+}
+
+func TestServerReady(t *testing.T) {
+	s := server.NewServer()
+	_ = s.Register(new(Bar))
+	l, _ := net.Listen("tcp", ":0")
+	defer func() { _ = l.Close() }()
+	go s.Accept(l)
+
+	select {
+	case <-s.Ready():
+	case <-time.After(time.Second):
+		t.Fatal("server should be ready once Accept has begun")
+	}
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "dial failed: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply int
+	err = client.Call(context.Background(), "Bar.Double", 2, &reply)
+	_assert(err == nil && reply == 4, "call Bar.Double failed: %d %v", reply, err)
+}
+
 func TestClientCall(t *testing.T) {
 	t.Parallel()
 	addrCh := make(chan string)
 	go startServer(addrCh)
 	addr := <-addrCh
-	time.Sleep(time.Second)
+	<-server.DefaultServer.Ready()
 	t.Run("client timeout", func(t *testing.T) {
 		client, _ := Dial("tcp", addr)
 		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
@@ -79,6 +138,117 @@ func TestClientCall(t *testing.T) {
 	})
 }
 
+func TestClientCallTimed(t *testing.T) {
+	t.Parallel()
+	addrCh := make(chan string)
+	go startServer(addrCh)
+	client, err := Dial("tcp", <-addrCh)
+	_assert(err == nil, "dial failed: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	d, err := client.CallTimed(context.Background(), "Bar.Timeout", 1, &reply)
+	_assert(err == nil, "call Bar.Timeout failed: %v", err)
+	_assert(d >= time.Second*2 && d < time.Second*3, "round-trip time should be about 2s, got %s", d)
+}
+
+func TestClientReplyTypeMismatch(t *testing.T) {
+	addrCh := make(chan string)
+	go startServer(addrCh)
+	client, err := Dial("tcp", <-addrCh)
+	_assert(err == nil, "dial failed: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply string
+	err = client.Call(context.Background(), "Bar.Double", 1, &reply)
+	var typeErr *ReplyTypeError
+	_assert(errors.As(err, &typeErr), "expect a ReplyTypeError, got %v", err)
+	_assert(typeErr.ServiceMethod == "Bar.Double" && typeErr.ReplyType == reflect.TypeOf(&reply),
+		"wrong ReplyTypeError: %v", typeErr)
+	_assert(strings.Contains(err.Error(), "*string") && strings.Contains(err.Error(), "int"),
+		"error should contain the expected and actual types: %v", err)
+}
+
+type Shape interface {
+	Area() int
+}
+
+type Rect struct {
+	Width, Height int
+}
+
+func (r Rect) Area() int {
+	return r.Width * r.Height
+}
+
+type ShapeArgs struct {
+	Shape Shape // an interface field, the concrete type must be registered
+}
+
+type Geometry int
+
+func (g Geometry) Area(args ShapeArgs, reply *int) error {
+	*reply = args.Shape.Area()
+	return nil
+}
+
+func TestRegisterGobType(t *testing.T) {
+	RegisterGobType(Rect{})
+	_, addr := startTestServer(t, new(Geometry))
+	client, err := Dial("tcp", addr)
+	_assert(err == nil, "dial failed: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	err = client.Call(context.Background(), "Geometry.Area", ShapeArgs{Shape: Rect{Width: 3, Height: 4}}, &reply)
+	_assert(err == nil && reply == 12, "expect area 12, got %d %v", reply, err)
+}
+
+func TestClientHandshakeRejected(t *testing.T) {
+	_, addr := startTestServer(t)
+	t.Run("bad magic number", func(t *testing.T) {
+		conn, _ := net.Dial("tcp", addr)
+		_, err := NewClient(conn, &server.Option{MagicNumber: 0x1234, CodecType: codec.GobType})
+		_assert(errors.Is(err, server.ErrBadMagicNumber), "expect ErrBadMagicNumber, got %v", err)
+	})
+	t.Run("bad codec", func(t *testing.T) {
+		conn, _ := net.Dial("tcp", addr)
+		defer func() { _ = conn.Close() }()
+		err := handshake(conn, &server.Option{MagicNumber: server.MagicNumber, CodecType: "application/unknown"})
+		_assert(errors.Is(err, server.ErrInvalidCodec), "expect ErrInvalidCodec, got %v", err)
+		_assert(!errors.Is(err, server.ErrBadMagicNumber), "errors of different codes should be distinct")
+	})
+}
+
+// 同一个服务端的不同连接可以使用不同的编码方式
+func TestServerMultipleCodecs(t *testing.T) {
+	_, addr := startTestServer(t, new(Bar))
+	codecTypes := []codec.Type{codec.GobType, codec.JsonType, codec.MsgpackType}
+
+	var wg sync.WaitGroup
+	for _, codecType := range codecTypes {
+		if codec.NewCodecFuncMap[codecType] == nil {
+			t.Logf("codec %s is not implemented, skip it", codecType)
+			continue
+		}
+		client, err := Dial("tcp", addr, &server.Option{CodecType: codecType})
+		_assert(err == nil, "dial with codec %s failed: %v", codecType, err)
+		defer func() { _ = client.Close() }()
+		for i := range 10 {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				var reply int
+				err := client.Call(context.Background(), "Bar.Double", i, &reply)
+				if err != nil || reply != i*2 {
+					t.Errorf("call Bar.Double over %s failed: %d %v", codecType, reply, err)
+				}
+			}(i)
+		}
+	}
+	wg.Wait()
+}
+
 func TestXDial(t *testing.T) {
 	t.Logf("\nruntime.GOOS is %s\n", runtime.GOOS)
 	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
@@ -106,3 +276,916 @@ func TestXDial(t *testing.T) {
 		}
 	}
 }
+
+func TestClientLazyReceive(t *testing.T) {
+	_, addr := startTestServer(t, new(Bar))
+	client, err := Dial("tcp", addr, &server.Option{LazyReceive: true})
+	_assert(err == nil, "dial failed: %v", err)
+	defer func() { _ = client.Close() }()
+
+	// receiving returns whether the receive goroutine of client is running
+	receiving := func() bool {
+		buf := make([]byte, 1<<20)
+		stacks := string(buf[:runtime.Stack(buf, true)])
+		return strings.Contains(stacks, fmt.Sprintf("(*Client).receive(%p", client))
+	}
+	_assert(!receiving(), "receive goroutine should not start before the first call")
+
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply int
+			err := client.Call(context.Background(), "Bar.Double", i, &reply)
+			_assert(err == nil && reply == i*2, "call Bar.Double failed: %d %v", reply, err)
+		}()
+	}
+	wg.Wait()
+	_assert(receiving(), "receive goroutine should run after the first call")
+}
+
+func TestClientMaxPendingCalls(t *testing.T) {
+	_, addr := startTestServer(t, new(Bar))
+	client, err := Dial("tcp", addr, &server.Option{MaxPendingCalls: 3})
+	_assert(err == nil, "dial failed: %v", err)
+	defer func() { _ = client.Close() }()
+
+	// Bar.Timeout 2s 后才响应，调用会一直处于 pending 状态
+	var reply int
+	for i := range 3 {
+		call := client.Go("Bar.Timeout", i, &reply, nil)
+		_assert(call.Error == nil, "call %d should be accepted: %v", i, call.Error)
+	}
+	_assert(client.Pending() == 3, "expect 3 pending calls, got %d", client.Pending())
+
+	call := client.Go("Bar.Timeout", 3, &reply, nil)
+	<-call.Done
+	_assert(errors.Is(call.Error, ErrTooManyPendingCalls), "expect ErrTooManyPendingCalls, got %v", call.Error)
+	_assert(client.Pending() == 3, "rejected call should not be pending, got %d", client.Pending())
+}
+
+func TestServerMaxHandleTimeout(t *testing.T) {
+	s, addr := startTestServer(t, new(Bar))
+	s.SetMaxHandleTimeout(200 * time.Millisecond)
+
+	opt := &server.Option{HandleTimeout: time.Minute}
+	client, err := Dial("tcp", addr, opt)
+	_assert(err == nil, "dial failed: %v", err)
+	defer func() { _ = client.Close() }()
+	_assert(client.opt.HandleTimeout == 200*time.Millisecond, "server should echo the clamped timeout, got %s", client.opt.HandleTimeout)
+	// 回复写入连接自己的 Option，不修改调用方传入的 Option 和 DefaultOption
+	_assert(opt.HandleTimeout == time.Minute, "the caller's option should not be modified, got %s", opt.HandleTimeout)
+
+	client2, err := Dial("tcp", addr)
+	_assert(err == nil, "dial failed: %v", err)
+	defer func() { _ = client2.Close() }()
+	_assert(client2.opt.HandleTimeout == 200*time.Millisecond, "server should echo the clamped timeout, got %s", client2.opt.HandleTimeout)
+	_assert(server.DefaultOption.HandleTimeout == 0, "DefaultOption should not be modified, got %s", server.DefaultOption.HandleTimeout)
+
+	// Bar.Timeout 需要 2s，应在限制后的 200ms 时被中断
+	var reply int
+	d, err := client.CallTimed(context.Background(), "Bar.Timeout", 1, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "handle timeout"), "expect a handle timeout error, got %v", err)
+	_assert(d < time.Second, "call should be cut off at the clamped timeout, took %s", d)
+}
+
+type traceIDKey struct{}
+
+type Trace int
+
+// TraceID replies the trace id found in the context of the request
+func (t Trace) TraceID(ctx context.Context, args int, reply *string) error {
+	*reply, _ = ctx.Value(traceIDKey{}).(string)
+	return nil
+}
+
+func TestPropagateContextKeys(t *testing.T) {
+	PropagateContextKeys(traceIDKey{})
+	_, addr := startTestServer(t, new(Trace))
+	client, err := Dial("tcp", addr)
+	_assert(err == nil, "dial failed: %v", err)
+	defer func() { _ = client.Close() }()
+
+	ctx := context.WithValue(context.Background(), traceIDKey{}, "trace-123")
+	var reply string
+	err = client.Call(ctx, "Trace.TraceID", 0, &reply)
+	_assert(err == nil && reply == "trace-123", "trace id should be propagated, got %q %v", reply, err)
+
+	// 没有 trace id 的调用不应该带上上一次的 metadata
+	err = client.Call(context.Background(), "Trace.TraceID", 0, &reply)
+	_assert(err == nil && reply == "", "expect no trace id, got %q %v", reply, err)
+}
+
+// Auth replies the signature found in the metadata of the request
+func (t Trace) Auth(ctx context.Context, args int, reply *string) error {
+	*reply = server.MetadataFromContext(ctx)["signature"]
+	return nil
+}
+
+func TestClientHeaderHook(t *testing.T) {
+	_, addr := startTestServer(t, new(Trace))
+	client, err := Dial("tcp", addr)
+	_assert(err == nil, "dial failed: %v", err)
+	defer func() { _ = client.Close() }()
+
+	client.SetHeaderHook(func(h *codec.Header) {
+		if h.Metadata == nil {
+			h.Metadata = make(map[string]string)
+		}
+		h.Metadata["signature"] = "signed:" + h.ServiceMethod
+		// 修改 Metadata 以外的字段不应该影响调用
+		h.Seq = 0
+		h.ServiceMethod = "Trace.Missing"
+		h.Oneway = true // 服务端不回复时调用会一直等待
+		h.Deadline = time.Now().Add(-time.Hour).UnixNano()
+		h.Error = "hooked"
+	})
+	var reply string
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = client.Call(ctx, "Trace.Auth", 0, &reply)
+	_assert(err == nil && reply == "signed:Trace.Auth", "server should read the metadata added by hook, got %q %v", reply, err)
+}
+
+type Pair struct {
+	A, B int
+}
+
+// Sum replies the sum of the pair
+func (b Bar) Sum(args Pair, reply *int) error {
+	*reply = args.A + args.B
+	return nil
+}
+
+func TestClientJsonCodec(t *testing.T) {
+	_, addr := startTestServer(t, new(Bar))
+	client, err := Dial("tcp", addr, &server.Option{CodecType: codec.JsonType})
+	_assert(err == nil, "dial with json codec failed: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	err = client.Call(context.Background(), "Bar.Sum", Pair{A: 1, B: 2}, &reply)
+	_assert(err == nil && reply == 3, "call Bar.Sum over json failed: %d %v", reply, err)
+
+	// 错误响应的 body 需要被正确丢弃，之后的调用不受影响
+	err = client.Call(context.Background(), "Bar.Missing", 1, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "can't find method"), "expect a method not found error, got %v", err)
+	err = client.Call(context.Background(), "Bar.Double", 4, &reply)
+	_assert(err == nil && reply == 8, "call Bar.Double over json failed: %d %v", reply, err)
+}
+
+func TestClientMsgpackCodec(t *testing.T) {
+	_, addr := startTestServer(t, new(Bar))
+	client, err := Dial("tcp", addr, &server.Option{CodecType: codec.MsgpackType})
+	_assert(err == nil, "dial with msgpack codec failed: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	err = client.Call(context.Background(), "Bar.Sum", Pair{A: 1, B: 2}, &reply)
+	_assert(err == nil && reply == 3, "call Bar.Sum over msgpack failed: %d %v", reply, err)
+
+	err = client.Call(context.Background(), "Bar.Missing", 1, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "can't find method"), "expect a method not found error, got %v", err)
+	err = client.Call(context.Background(), "Bar.Double", 4, &reply)
+	_assert(err == nil && reply == 8, "call Bar.Double over msgpack failed: %d %v", reply, err)
+
+	// 非 Go 的对端按字段名解析 header
+	data, err := msgpack.Marshal(&codec.Header{ServiceMethod: "Bar.Sum", Seq: 1})
+	_assert(err == nil, "marshal header failed: %v", err)
+	var m map[string]any
+	_assert(msgpack.Unmarshal(data, &m) == nil, "header should be encoded as a map")
+	_assert(m["ServiceMethod"] == "Bar.Sum" && len(m) == 3, "unexpected header keys: %v", m)
+}
+
+func TestClientProtocolVersion1(t *testing.T) {
+	_, addr := startTestServer(t, new(Bar))
+	// 版本 1 的客户端不分帧，服务端需要按照版本选择 codec
+	for _, codecType := range []codec.Type{codec.GobType, codec.JsonType, codec.MsgpackType} {
+		client, err := Dial("tcp", addr, &server.Option{ProtocolVersion: 1, CodecType: codecType})
+		_assert(err == nil, "dial with protocol version 1 failed: %v", err)
+		var reply int
+		err = client.Call(context.Background(), "Bar.Double", 3, &reply)
+		_assert(err == nil && reply == 6, "call over protocol version 1 (%s) failed: %d %v", codecType, reply, err)
+		_ = client.Close()
+	}
+}
+
+// Range replies the slice [0, n)
+func (b Bar) Range(n int, reply *[]int) error {
+	for i := range n {
+		*reply = append(*reply, i%10)
+	}
+	return nil
+}
+
+// countingConn counts the bytes read from the connection
+type countingConn struct {
+	net.Conn
+	read int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read += int64(n)
+	return n, err
+}
+
+func TestClientCompress(t *testing.T) {
+	_, addr := startTestServer(t, new(Bar))
+	for _, compress := range []codec.CompressType{codec.CompressNone, codec.CompressGzip, codec.CompressSnappy} {
+		client, err := Dial("tcp", addr, &server.Option{CompressType: compress})
+		_assert(err == nil, "dial with compress %q failed: %v", compress, err)
+		var reply []int
+		err = client.Call(context.Background(), "Bar.Range", 1000, &reply)
+		_assert(err == nil && len(reply) == 1000 && reply[999] == 9, "call Bar.Range with compress %q failed: %v", compress, err)
+		_ = client.Close()
+	}
+
+	_, err := Dial("tcp", addr, &server.Option{CompressType: "zstd"})
+	_assert(errors.Is(err, server.ErrInvalidCompress), "expect ErrInvalidCompress, got %v", err)
+}
+
+func BenchmarkClientCompress(b *testing.B) {
+	s := server.NewServer()
+	_ = s.Register(new(Bar))
+	l, _ := net.Listen("tcp", ":0")
+	defer func() { _ = l.Close() }()
+	go s.Accept(l)
+
+	for _, compress := range []codec.CompressType{codec.CompressNone, codec.CompressGzip, codec.CompressSnappy} {
+		name := string(compress)
+		if name == "" {
+			name = "none"
+		}
+		b.Run(name, func(b *testing.B) {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			counter := &countingConn{Conn: conn}
+			client, err := NewClient(counter, &server.Option{
+				MagicNumber:     server.MagicNumber,
+				ProtocolVersion: server.ProtocolVersion,
+				CodecType:       codec.GobType,
+				CompressType:    compress,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer func() { _ = client.Close() }()
+			b.ResetTimer()
+			for range b.N {
+				var reply []int
+				if err := client.Call(context.Background(), "Bar.Range", 10000, &reply); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(counter.read)/float64(b.N), "wire-B/op")
+		})
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	s, addr := startTestServer(t, new(Bar))
+	// 服务端关闭空闲的连接，模拟连接断开
+	s.SetIdleTimeout(100 * time.Millisecond)
+
+	waitDropped := func(client *Client) {
+		for i := 0; client.IsAvailable(); i++ {
+			_assert(i < 200, "connection should be dropped by the server")
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	client, err := Dial("tcp", addr, &server.Option{Reconnect: true})
+	_assert(err == nil, "dial failed: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply int
+	_assert(client.Call(context.Background(), "Bar.Double", 1, &reply) == nil && reply == 2, "first call failed")
+	waitDropped(client)
+	dropped := client.cc
+	for i := range 3 {
+		err = client.Call(context.Background(), "Bar.Double", i, &reply)
+		_assert(err == nil && reply == i*2, "call after reconnect failed: %d %v", reply, err)
+	}
+	// 重连后断开的连接已被关闭，再次关闭返回错误
+	_assert(dropped.Close() != nil, "the dropped connection should be closed on reconnect")
+
+	// 没有开启 Reconnect 时，断开后的调用直接失败
+	client2, err := Dial("tcp", addr)
+	_assert(err == nil, "dial failed: %v", err)
+	defer func() { _ = client2.Close() }()
+	waitDropped(client2)
+	err = client2.Call(context.Background(), "Bar.Double", 1, &reply)
+	_assert(errors.Is(err, ErrShutdown), "expect ErrShutdown without Reconnect, got %v", err)
+}
+
+func TestClientReconnectBackoff(t *testing.T) {
+	s := server.NewServer()
+	_ = s.Register(new(Bar))
+	l, err := net.Listen("tcp", ":0")
+	_assert(err == nil, "listen failed: %v", err)
+	go s.Accept(l)
+	<-s.Ready()
+	s.SetIdleTimeout(100 * time.Millisecond)
+
+	client, err := Dial("tcp", l.Addr().String(), &server.Option{Reconnect: true, ReconnectBackoff: time.Hour})
+	_assert(err == nil, "dial failed: %v", err)
+	defer func() { _ = client.Close() }()
+	defaultClient, err := Dial("tcp", l.Addr().String(), &server.Option{Reconnect: true})
+	_assert(err == nil, "dial failed: %v", err)
+	defer func() { _ = defaultClient.Close() }()
+	// 关闭监听后，连接被服务端关闭，重连也会失败
+	_ = l.Close()
+	for i := 0; client.IsAvailable() || defaultClient.IsAvailable(); i++ {
+		_assert(i < 200, "connection should be dropped by the server")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var reply int
+	err = client.Call(context.Background(), "Bar.Double", 1, &reply)
+	_assert(err != nil, "call should fail while the server is down")
+	// 重连失败后退避，期间不再尝试重连，调用立即失败
+	err = client.Call(context.Background(), "Bar.Double", 1, &reply)
+	_assert(errors.Is(err, ErrShutdown), "expect ErrShutdown during backoff, got %v", err)
+	_assert(client.nextRedial.After(time.Now().Add(time.Minute)), "expect the next reconnect to be delayed by the backoff")
+
+	// 没有设置 ReconnectBackoff 时同样退避，不会每次调用都重连
+	err = defaultClient.Call(context.Background(), "Bar.Double", 1, &reply)
+	_assert(err != nil, "call should fail while the server is down")
+	err = defaultClient.Call(context.Background(), "Bar.Double", 1, &reply)
+	_assert(errors.Is(err, ErrShutdown), "expect ErrShutdown during the default backoff, got %v", err)
+}
+
+// Counter records the notifications it received
+type Counter struct {
+	release chan struct{}
+	hits    chan int
+}
+
+func (c *Counter) Add(n int, reply *int) error {
+	<-c.release
+	c.hits <- n
+	*reply = n
+	return nil
+}
+
+func TestClientNotify(t *testing.T) {
+	counter := &Counter{release: make(chan struct{}), hits: make(chan int, 1)}
+	_, addr := startTestServer(t, counter)
+	client, err := Dial("tcp", addr)
+	_assert(err == nil, "dial failed: %v", err)
+	defer func() { _ = client.Close() }()
+
+	// 服务端的方法还没有返回，Notify 写入请求后就返回
+	err = client.Notify(context.Background(), "Counter.Add", 7)
+	_assert(err == nil, "notify failed: %v", err)
+	_assert(client.Pending() == 0, "oneway call should not be pending")
+	close(counter.release)
+	select {
+	case n := <-counter.hits:
+		_assert(n == 7, "expect the method to be invoked with 7, got %d", n)
+	case <-time.After(time.Second):
+		t.Fatal("the method of the oneway call is not invoked")
+	}
+
+	// 服务端没有发送响应，之后的调用不受影响
+	var reply int
+	err = client.Call(context.Background(), "Counter.Add", 3, &reply)
+	_assert(err == nil && reply == 3, "call after notify failed: %d %v", reply, err)
+	_assert(<-counter.hits == 3, "expect the method to be invoked by the call")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_assert(errors.Is(client.Notify(ctx, "Counter.Add", 1), context.Canceled), "notify with a canceled context should fail")
+}
+
+func TestXClientPool(t *testing.T) {
+	_, addr := startTestServer(t, new(Bar))
+	xc := NewXClient(discovery.NewMultiServerDiscovery([]string{"tcp@" + addr}), discovery.RoundRobinSelect, nil)
+	xc.SetPoolSize(2)
+
+	var reply int
+	for i := range 4 {
+		err := xc.Call(context.Background(), "Bar.Double", i, &reply)
+		_assert(err == nil && reply == i*2, "call failed: %d %v", reply, err)
+	}
+	pool := xc.clients["tcp@"+addr]
+	_assert(len(pool) == 2 && pool[0] != nil && pool[1] != nil && pool[0] != pool[1], "expect 2 connections in the pool, got %v", pool)
+
+	// 连接池变小时，多出的连接被关闭
+	xc.SetPoolSize(1)
+	_assert(xc.Call(context.Background(), "Bar.Double", 1, &reply) == nil, "call after shrinking the pool failed")
+	_assert(!pool[1].IsAvailable(), "the connection beyond the pool size should be closed")
+
+	_assert(xc.Close() == nil, "close failed")
+	_assert(!pool[0].IsAvailable(), "close should close all connections in the pool")
+}
+
+// 并发调用时，连接池可以提高吞吐量
+func BenchmarkXClientPool(b *testing.B) {
+	s := server.NewServer()
+	_ = s.Register(new(Bar))
+	l, _ := net.Listen("tcp", ":0")
+	defer func() { _ = l.Close() }()
+	go s.Accept(l)
+	<-s.Ready()
+
+	for _, size := range []int{1, DefaultPoolSize} {
+		b.Run(fmt.Sprintf("pool=%d", size), func(b *testing.B) {
+			d := discovery.NewMultiServerDiscovery([]string{"tcp@" + l.Addr().String()})
+			xc := NewXClient(d, discovery.RoundRobinSelect, nil)
+			defer func() { _ = xc.Close() }()
+			xc.SetPoolSize(size)
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					var reply []int
+					if err := xc.Call(context.Background(), "Bar.Range", 1000, &reply); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// Failing counts the calls of Fail, which always returns an error
+type Failing struct{ calls *atomic.Int32 }
+
+func (f Failing) Fail(_ int, _ *int) error {
+	f.calls.Add(1)
+	return errors.New("failing")
+}
+
+func TestXClientRetry(t *testing.T) {
+	calls := new(atomic.Int32)
+	_, addr := startTestServer(t, new(Bar), Failing{calls})
+	_, addr2 := startTestServer(t, Failing{calls})
+	// 一个已经关闭的地址，连接会被拒绝
+	l, err := net.Listen("tcp", ":0")
+	_assert(err == nil, "listen failed: %v", err)
+	deadAddr := l.Addr().String()
+	_ = l.Close()
+
+	servers := []string{"tcp@" + deadAddr, "tcp@" + addr}
+	xc := NewXClient(discovery.NewMultiServerDiscovery(servers), discovery.RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetRetry(2, 10*time.Millisecond)
+	for i := range 4 {
+		var reply int
+		err := xc.Call(context.Background(), "Bar.Double", i, &reply)
+		_assert(err == nil && reply == i*2, "call should be retried on the live server: %d %v", reply, err)
+	}
+
+	// 没有指定 Backoff 时使用默认的指数退避
+	xcDefault := NewXClient(discovery.NewMultiServerDiscovery(servers), discovery.RoundRobinSelect, nil)
+	defer func() { _ = xcDefault.Close() }()
+	xcDefault.SetRetryBackoff(2, nil)
+	for i := range 2 {
+		var reply int
+		err := xcDefault.Call(context.Background(), "Bar.Double", i, &reply)
+		_assert(err == nil && reply == i*2, "call should be retried with the default backoff: %d %v", reply, err)
+	}
+
+	// 不重试时，选中关闭的地址会直接失败，也不会标记到服务发现中
+	xc = NewXClient(discovery.NewMultiServerDiscovery(servers), discovery.RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	var failed int
+	for i := range 4 {
+		var reply int
+		if xc.Call(context.Background(), "Bar.Double", i, &reply) != nil {
+			failed++
+		}
+	}
+	_assert(failed == 2, "expect every call on the closed address to fail, got %d", failed)
+
+	// 服务端方法返回的错误不会重试
+	xc2 := NewXClient(discovery.NewMultiServerDiscovery([]string{"tcp@" + addr, "tcp@" + addr2}), discovery.RoundRobinSelect, nil)
+	defer func() { _ = xc2.Close() }()
+	xc2.SetRetry(3, 10*time.Millisecond)
+	err = xc2.Call(context.Background(), "Failing.Fail", 1, new(int))
+	_assert(err != nil && err.Error() == "failing", "expect the method error, got %v", err)
+	_assert(calls.Load() == 1, "application errors should not be retried, got %d calls", calls.Load())
+}
+
+// Dropping signals started once Run is called, then runs until the connection is dropped
+type Dropping struct {
+	calls   *atomic.Int32
+	started chan struct{}
+}
+
+func (d Dropping) Run(_ int, _ *int) error {
+	d.calls.Add(1)
+	d.started <- struct{}{}
+	time.Sleep(100 * time.Millisecond)
+	return nil
+}
+
+// connsListener records the accepted connections so that a test can drop them
+type connsListener struct {
+	net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (l *connsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.mu.Lock()
+		l.conns = append(l.conns, conn)
+		l.mu.Unlock()
+	}
+	return conn, err
+}
+
+func (l *connsListener) dropAll() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, conn := range l.conns {
+		_ = conn.Close()
+	}
+}
+
+func TestXClientNoRetryAfterSent(t *testing.T) {
+	calls := new(atomic.Int32)
+	var servers []string
+	var listeners []*connsListener
+	for range 2 {
+		s := server.NewServer()
+		_ = s.Register(Dropping{calls: calls, started: make(chan struct{}, 1)})
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		_assert(err == nil, "listen failed: %v", err)
+		cl := &connsListener{Listener: l}
+		t.Cleanup(func() { _ = l.Close() })
+		go s.Accept(cl)
+		<-s.Ready()
+		servers = append(servers, "tcp@"+l.Addr().String())
+		listeners = append(listeners, cl)
+	}
+	xc := NewXClient(discovery.NewMultiServerDiscovery(servers), discovery.RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetRetry(3, 10*time.Millisecond)
+
+	// 请求发出后连接断开，服务端可能已经执行了方法，不能在另一台服务器上重试
+	done := make(chan error, 1)
+	go func() { done <- xc.Call(context.Background(), "Dropping.Run", 1, new(int)) }()
+	deadline := time.After(time.Second)
+	for calls.Load() == 0 {
+		select {
+		case <-deadline:
+			t.Fatal("the method should be called")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+	for _, l := range listeners {
+		l.dropAll()
+	}
+	err := <-done
+	_assert(err != nil, "the call should fail once the connection is dropped")
+	time.Sleep(150 * time.Millisecond)
+	_assert(calls.Load() == 1, "a call dropped after it was sent should not be retried, got %d runs", calls.Load())
+}
+
+// Node fails Ping if fail is set
+type Node struct{ fail bool }
+
+func (n Node) Ping(_ int, reply *string) error {
+	if n.fail {
+		return errors.New("node failed")
+	}
+	*reply = "pong"
+	return nil
+}
+
+func TestXClientBroadcastError(t *testing.T) {
+	_, ok := startTestServer(t, Node{})
+	_, failing := startTestServer(t, Node{fail: true})
+	l, err := net.Listen("tcp", ":0")
+	_assert(err == nil, "listen failed: %v", err)
+	dead := l.Addr().String()
+	_ = l.Close()
+
+	servers := []string{"tcp@" + ok, "tcp@" + failing, "tcp@" + dead}
+	xc := NewXClient(discovery.NewMultiServerDiscovery(servers), discovery.RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+	var reply string
+	err = xc.Broadcast(context.Background(), "Node.Ping", 1, &reply)
+
+	var be *BroadcastError
+	_assert(errors.As(err, &be), "expect a *BroadcastError, got %v", err)
+	_assert(len(be.Errors) == 2, "expect 2 failed servers, got %v", be.Errors)
+	_assert(be.Errors[servers[1]] != nil && be.Errors[servers[1]].Error() == "node failed", "unexpected error of %s: %v", servers[1], be.Errors[servers[1]])
+	_assert(be.Errors[servers[2]] != nil, "expect the dead server %s to fail", servers[2])
+	var opErr *net.OpError
+	_assert(errors.As(err, &opErr), "errors.As should find the dial error")
+	_assert(strings.Contains(err.Error(), servers[1]) && strings.Contains(err.Error(), servers[2]), "error should name the failed servers: %v", err)
+	_assert(reply == "pong", "expect the reply of the healthy server, got %q", reply)
+}
+
+func TestClientChecksum(t *testing.T) {
+	_, addr := startTestServer(t, new(Bar))
+	for _, codecType := range []codec.Type{codec.GobType, codec.JsonType, codec.MsgpackType} {
+		client, err := Dial("tcp", addr, &server.Option{CodecType: codecType, Checksum: true})
+		_assert(err == nil, "dial with checksum failed: %v", err)
+		var reply int
+		err = client.Call(context.Background(), "Bar.Sum", Pair{A: 1, B: 2}, &reply)
+		_assert(err == nil && reply == 3, "call with checksum over %s failed: %d %v", codecType, reply, err)
+		_ = client.Close()
+	}
+
+	// 不分帧的协议版本 1 不支持校验和
+	_, err := Dial("tcp", addr, &server.Option{ProtocolVersion: 1, Checksum: true})
+	_assert(errors.Is(err, server.ErrInvalidChecksum), "expect ErrInvalidChecksum, got %v", err)
+}
+
+func TestXClientCallWithKey(t *testing.T) {
+	calls := make(map[string]*atomic.Int32)
+	var servers []string
+	for range 3 {
+		n := new(atomic.Int32)
+		_, addr := startTestServer(t, Failing{n})
+		calls["tcp@"+addr] = n
+		servers = append(servers, "tcp@"+addr)
+	}
+	xc := NewXClient(discovery.NewMultiServerDiscovery(servers), discovery.ConsistentHashSelect, nil)
+	defer func() { _ = xc.Close() }()
+	for range 5 {
+		_ = xc.CallWithKey(context.Background(), "user-42", "Failing.Fail", 1, new(int))
+	}
+	// 同一个 key 的调用都落在同一台服务器上
+	var hit int
+	for _, n := range calls {
+		if n.Load() > 0 {
+			hit++
+			_assert(n.Load() == 5, "expect all 5 calls on one server, got %d", n.Load())
+		}
+	}
+	_assert(hit == 1, "expect calls of one key to hit one server, got %d servers", hit)
+}
+
+func TestXClientBroadcastAll(t *testing.T) {
+	_, ok := startTestServer(t, Node{})
+	_, ok2 := startTestServer(t, Node{})
+	_, failing := startTestServer(t, Node{fail: true})
+	servers := []string{"tcp@" + ok, "tcp@" + ok2, "tcp@" + failing}
+	xc := NewXClient(discovery.NewMultiServerDiscovery(servers), discovery.RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	replies, errs := xc.BroadcastAll(context.Background(), "Node.Ping", 1, reflect.TypeOf(""))
+	_assert(len(replies) == 2 && len(errs) == 1, "expect 2 replies and 1 error, got %v %v", replies, errs)
+	for _, addr := range servers[:2] {
+		reply, _ := replies[addr].(*string)
+		_assert(reply != nil && *reply == "pong", "unexpected reply of %s: %v", addr, replies[addr])
+	}
+	// 每个实例的 reply 是单独分配的
+	_assert(replies[servers[0]] != replies[servers[1]], "replies should not be shared")
+	_assert(errs[servers[2]] != nil && errs[servers[2]].Error() == "node failed", "unexpected error of %s: %v", servers[2], errs[servers[2]])
+}
+
+// Waiter waits until d has passed or ctx is done, the error of ctx is sent to done
+type Waiter struct{ done chan error }
+
+func (w Waiter) Wait(ctx context.Context, d time.Duration, reply *int) error {
+	select {
+	case <-ctx.Done():
+		w.done <- ctx.Err()
+	case <-time.After(d):
+		w.done <- nil
+	}
+	return nil
+}
+
+func TestClientDeadlinePropagation(t *testing.T) {
+	w := Waiter{done: make(chan error, 1)}
+	_, addr := startTestServer(t, w)
+	client, err := Dial("tcp", addr, &server.Option{HandleTimeout: 5 * time.Second})
+	_assert(err == nil, "dial failed: %v", err)
+	defer func() { _ = client.Close() }()
+
+	// 客户端的超时比 HandleTimeout 短，服务端的方法在客户端的截止时间到达时就被取消
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = client.Call(ctx, "Waiter.Wait", 3*time.Second, new(int))
+	_assert(err != nil, "call should time out on the client")
+	select {
+	case err := <-w.done:
+		_assert(errors.Is(err, context.DeadlineExceeded), "expect the method context to exceed the deadline, got %v", err)
+		_assert(time.Since(start) < time.Second, "method should stop at the client deadline, took %s", time.Since(start))
+	case <-time.After(2 * time.Second):
+		t.Fatal("the method was not canceled at the client deadline")
+	}
+
+	// 没有截止时间时不受影响
+	err = client.Call(context.Background(), "Waiter.Wait", 10*time.Millisecond, new(int))
+	_assert(err == nil && <-w.done == nil, "call without deadline failed: %v", err)
+}
+
+func TestServerShutdown(t *testing.T) {
+	w := Waiter{done: make(chan error, 1)}
+	s, addr := startTestServer(t, w)
+	client, err := Dial("tcp", addr, nil)
+	_assert(err == nil, "dial failed: %v", err)
+	defer func() { _ = client.Close() }()
+
+	call := client.Go("Waiter.Wait", 300*time.Millisecond, new(int), make(chan *Call, 1))
+	time.Sleep(100 * time.Millisecond) // let the call reach the server
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err = s.Shutdown(ctx)
+	_assert(err == nil, "shutdown should wait for the in-flight call: %v", err)
+	// Shutdown 返回时处理中的请求已经回复
+	select {
+	case call = <-call.Done:
+		_assert(call.Error == nil, "in-flight call should complete: %v", call.Error)
+	case <-time.After(time.Second):
+		t.Fatal("in-flight call should complete")
+	}
+
+	_, err = Dial("tcp", addr, &server.Option{ConnectTimeout: time.Second})
+	_assert(err != nil, "dial should fail after shutdown")
+}
+
+func TestDialInMemory(t *testing.T) {
+	s := server.NewServer()
+	_ = s.Register(new(Bar))
+	client, err := DialInMemory(s)
+	_assert(err == nil, "dial in memory failed: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	err = client.Call(context.Background(), "Bar.Sum", Pair{A: 1, B: 2}, &reply)
+	_assert(err == nil && reply == 3, "expect 3, got %d %v", reply, err)
+}
+
+type Panicker int
+
+func (p Panicker) Panic(_ int, _ *int) error {
+	panic("boom")
+}
+
+func TestServerRecoversFromPanic(t *testing.T) {
+	s := server.NewServer()
+	_ = s.Register(new(Panicker))
+	_ = s.Register(new(Bar))
+	client, err := DialInMemory(s)
+	_assert(err == nil, "dial in memory failed: %v", err)
+	defer func() { _ = client.Close() }()
+
+	err = client.Call(context.Background(), "Panicker.Panic", 1, new(int))
+	_assert(err != nil && strings.Contains(err.Error(), "boom"), "expect the panic as an error, got %v", err)
+
+	// 服务端没有崩溃，同一个连接继续提供服务
+	var reply int
+	err = client.Call(context.Background(), "Bar.Double", 2, &reply)
+	_assert(err == nil && reply == 4, "expect 4 after the panic, got %d %v", reply, err)
+}
+
+func TestClientGoCtx(t *testing.T) {
+	s := server.NewServer()
+	_ = s.Register(new(Bar))
+	client, err := DialInMemory(s)
+	_assert(err == nil, "dial in memory failed: %v", err)
+	defer func() { _ = client.Close() }()
+
+	// Bar.Timeout 执行 2 秒，ctx 取消后调用立即完成，并从 pending 中移除
+	ctx, cancel := context.WithCancel(context.Background())
+	call := client.GoCtx(ctx, "Bar.Timeout", 1, new(int), make(chan *Call, 1))
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case call = <-call.Done:
+		_assert(errors.Is(call.Error, context.Canceled), "expect the cancellation, got %v", call.Error)
+	case <-time.After(time.Second):
+		t.Fatal("the call should complete once ctx is canceled")
+	}
+	_assert(client.Pending() == 0, "the canceled call should not be pending, got %d", client.Pending())
+
+	// ctx 没有结束时与 Go 相同
+	call = client.GoCtx(context.Background(), "Bar.Double", 2, new(int), nil)
+	call = <-call.Done
+	_assert(call.Error == nil && *call.Reply.(*int) == 4, "expect 4, got %v %v", call.Reply, call.Error)
+}
+
+// selfSignedTLS generates a certificate for 127.0.0.1, returns the server
+// config and a client config trusting it
+func selfSignedTLS(t *testing.T) (*tls.Config, *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "aurerpc test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	serverCfg := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	return serverCfg, &tls.Config{RootCAs: pool}
+}
+
+func TestDialTLS(t *testing.T) {
+	serverCfg, clientCfg := selfSignedTLS(t)
+	s := server.NewServer()
+	_ = s.Register(new(Bar))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	_assert(err == nil, "listen failed: %v", err)
+	t.Cleanup(func() { _ = l.Close() })
+	go s.ServeTLS(l, serverCfg)
+	<-s.Ready()
+	addr := l.Addr().String()
+
+	// Option 交换和 codec 协商在加密连接上照常进行
+	for _, codecType := range []codec.Type{codec.GobType, codec.JsonType} {
+		client, err := DialTLS("tcp", addr, clientCfg, &server.Option{CodecType: codecType, ConnectTimeout: time.Second})
+		_assert(err == nil, "dial tls with %s failed: %v", codecType, err)
+		var reply int
+		err = client.Call(context.Background(), "Bar.Sum", Pair{A: 1, B: 2}, &reply)
+		_assert(err == nil && reply == 3, "expect 3 with %s, got %d %v", codecType, reply, err)
+		_ = client.Close()
+	}
+
+	// 不信任服务端证书时握手失败
+	_, err = DialTLS("tcp", addr, &tls.Config{}, &server.Option{ConnectTimeout: time.Second})
+	_assert(err != nil, "dial should fail with an untrusted certificate")
+}
+
+func TestClientToken(t *testing.T) {
+	s := server.NewServer()
+	_ = s.Register(new(Bar))
+	s.SetAuthFunc(func(token string) bool { return token == "secret" })
+
+	client, err := DialInMemory(s, &server.Option{Token: "secret"})
+	_assert(err == nil, "dial with a valid token failed: %v", err)
+	var reply int
+	err = client.Call(context.Background(), "Bar.Sum", Pair{A: 1, B: 2}, &reply)
+	_assert(err == nil && reply == 3, "expect 3, got %d %v", reply, err)
+	_ = client.Close()
+
+	for _, token := range []string{"", "wrong"} {
+		_, err = DialInMemory(s, &server.Option{Token: token})
+		_assert(errors.Is(err, server.ErrUnauthorized), "expect ErrUnauthorized for %q, got %v", token, err)
+	}
+
+	// 未设置认证函数时不校验 token
+	s.SetAuthFunc(nil)
+	client, err = DialInMemory(s)
+	_assert(err == nil, "dial without auth func failed: %v", err)
+	_ = client.Close()
+}
+
+func TestServerRateLimit(t *testing.T) {
+	s := server.NewServer()
+	_ = s.Register(new(Bar))
+	s.SetRateLimit(10, 3)
+	client, err := DialInMemory(s)
+	_assert(err == nil, "dial in memory failed: %v", err)
+	defer func() { _ = client.Close() }()
+
+	// 请求速度远超限制，只有 burst 个请求被处理，其余立即返回错误
+	calls := make([]*Call, 10)
+	for i := range calls {
+		calls[i] = client.Go("Bar.Double", i, new(int), nil)
+	}
+	var ok, limited int
+	for _, call := range calls {
+		<-call.Done
+		switch {
+		case call.Error == nil:
+			ok++
+		case strings.Contains(call.Error.Error(), "rate limited"):
+			limited++
+		default:
+			t.Fatalf("unexpected error: %v", call.Error)
+		}
+	}
+	_assert(ok >= 3 && ok < 10 && ok+limited == 10, "expect some calls to be rate limited, got %d ok %d limited", ok, limited)
+
+	// 令牌恢复后请求重新被处理
+	time.Sleep(200 * time.Millisecond)
+	var reply int
+	err = client.Call(context.Background(), "Bar.Double", 2, &reply)
+	_assert(err == nil && reply == 4, "expect 4 after tokens refill, got %d %v", reply, err)
+}
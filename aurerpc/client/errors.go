@@ -1,5 +1,75 @@
 package client
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
 
 var ErrShutdown = errors.New("client: connection is shut down")
+
+// ErrTooManyPendingCalls is returned when the number of calls waiting for
+// a response has reached Option.MaxPendingCalls.
+var ErrTooManyPendingCalls = errors.New("rpc client: too many pending calls")
+
+// notSentError wraps an error that happened before the request was written to the connection,
+// e.g. a dial error or a connection reset while sending, the server has never run the request,
+// so XClient can safely retry it on another server. Other errors, such as a connection dropped
+// while waiting for the reply, are not retried: the server may have run the method already.
+type notSentError struct {
+	err error
+}
+
+func (e *notSentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *notSentError) Unwrap() error {
+	return e.err
+}
+
+// ReplyTypeError is returned when the reply sent by the server can't be decoded
+// into the reply passed by the caller, usually because their types mismatch.
+type ReplyTypeError struct {
+	ServiceMethod string
+	ReplyType     reflect.Type // type of the reply passed by the caller
+	Err           error        // error returned by the codec
+}
+
+func (e *ReplyTypeError) Error() string {
+	return fmt.Sprintf("rpc client: can't decode reply of %s into %v: %v", e.ServiceMethod, e.ReplyType, e.Err)
+}
+
+func (e *ReplyTypeError) Unwrap() error {
+	return e.Err
+}
+
+// BroadcastError is returned by XClient.Broadcast when the call fails on any server,
+// Errors maps the address of each failed server to its error.
+// errors.Is and errors.As check the error of every server.
+type BroadcastError struct {
+	Errors map[string]error
+}
+
+func (e *BroadcastError) Error() string {
+	addrs := make([]string, 0, len(e.Errors))
+	for addr := range e.Errors {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	msgs := make([]string, len(addrs))
+	for i, addr := range addrs {
+		msgs[i] = addr + ": " + e.Errors[addr].Error()
+	}
+	return fmt.Sprintf("rpc client: broadcast failed on %d servers: %s", len(addrs), strings.Join(msgs, "; "))
+}
+
+func (e *BroadcastError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		errs = append(errs, err)
+	}
+	return errs
+}
@@ -0,0 +1,20 @@
+package client
+
+import (
+	"net"
+
+	"aurerpc/server"
+)
+
+// DialInMemory connects to srv through an in-memory pipe instead of a socket,
+// the connection is served by srv.ServeConn directly.
+// 不需要监听端口，适合编写快速、确定的测试；Option.Reconnect 对这种连接不生效
+func DialInMemory(srv *server.Server, opts ...*server.Option) (*Client, error) {
+	opt, err := parseOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	conn, srvConn := net.Pipe()
+	go srv.ServeConn(srvConn)
+	return NewClient(conn, opt)
+}
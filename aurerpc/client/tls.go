@@ -0,0 +1,37 @@
+package client
+
+import (
+	"crypto/tls"
+	"net"
+
+	"aurerpc/server"
+)
+
+// DialTLS connects to an RPC server at the specified network address over TLS,
+// the connection is wrapped in a TLS client using cfg before the Option handshake.
+// cfg 没有设置 ServerName 时使用 address 中的主机名校验证书
+func DialTLS(network, address string, cfg *tls.Config, opts ...*server.Option) (*Client, error) {
+	return dialTimeout(tlsClientFunc(network, address, cfg, NewClient), network, address, opts...)
+}
+
+// tlsClientFunc wraps f so that the TLS handshake is done before f,
+// it is also used when the client reconnects.
+func tlsClientFunc(network, address string, cfg *tls.Config, f newClientFunc) newClientFunc {
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	if cfg.ServerName == "" && network != "unix" {
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			cfg = cfg.Clone()
+			cfg.ServerName = host
+		}
+	}
+	return func(conn net.Conn, opt *server.Option) (*Client, error) {
+		tlsConn := tls.Client(conn, cfg)
+		// 握手在 dialTimeout 的子协程中执行，受 ConnectTimeout 限制
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		return f(tlsConn, opt)
+	}
+}
@@ -4,10 +4,13 @@ import (
 	"context"
 	"errors"
 	"io"
+	"log"
 	"reflect"
 	"strings"
 	"sync"
+	"time"
 
+	"aurerpc/backoff"
 	"aurerpc/discovery"
 	"aurerpc/server"
 )
@@ -18,30 +21,60 @@ type XClient struct {
 	mode    discovery.SelectMode // 选择负载均衡方式
 	opt     *server.Option       // rpc连接选项
 	mu      sync.Mutex
-	clients map[string]*Client
+	clients map[string][]*Client // 每个地址一个连接池，池中的连接按需创建
+	next    map[string]int       // 每个地址下一次使用的连接，轮询连接池
+	// 每个地址最多的连接数，所有调用共享一个连接时，吞吐量受限于这一个连接
+	poolSize int
+	// 重试策略，见 SetRetry，maxAttempts 为 0 时不重试
+	maxAttempts int
+	newBackoff  func() backoff.Backoff // 每次调用创建一个，计算重试之间的等待时间
 }
 
+// DefaultPoolSize is the default number of connections per address of an XClient
+const DefaultPoolSize = 4
+
+// badServerCooldown is how long a server failed by a retriable error is skipped by discovery
+const badServerCooldown = 10 * time.Second
+
+// defaultRetryWait is the first wait between attempts when SetRetryBackoff is given no Backoff
+const defaultRetryWait = 100 * time.Millisecond
+
 var _ io.Closer = (*XClient)(nil)
 
 // 需要传入三个参数，服务发现实例 Discovery，负载均衡模式 SelectMode 以及协议选项 Option
 // 尽量复用已经创建好的 Socket 连接，使用 clients 保存创建成功的 Client 实例
 func NewXClient(d discovery.Discovery, mode discovery.SelectMode, opt *server.Option) *XClient {
 	return &XClient{
-		d:       d,
-		mode:    mode,
-		opt:     opt,
-		clients: make(map[string]*Client),
+		d:        d,
+		mode:     mode,
+		opt:      opt,
+		clients:  make(map[string][]*Client),
+		next:     make(map[string]int),
+		poolSize: DefaultPoolSize,
 	}
 }
 
+// SetPoolSize sets the max number of connections per address, n less than 1 is treated as 1.
+// 连接池变小时，多出的连接会在下一次使用该地址时关闭
+func (xc *XClient) SetPoolSize(n int) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.poolSize = max(n, 1)
+}
+
 func (xc *XClient) Close() error {
 	xc.mu.Lock()
 	defer xc.mu.Unlock()
 
 	var errs []error
-	for key, client := range xc.clients {
-		if err := client.Close(); err != nil {
-			errs = append(errs, err)
+	for key, pool := range xc.clients {
+		for _, client := range pool {
+			if client == nil {
+				continue
+			}
+			if err := client.Close(); err != nil {
+				errs = append(errs, err)
+			}
 		}
 		delete(xc.clients, key)
 	}
@@ -63,12 +96,15 @@ func aggregateErrors(errs []error) string {
 func (xc *XClient) dial(rpcAddr string) (*Client, error) {
 	xc.mu.Lock()
 	defer xc.mu.Unlock()
-	// 1. 检查 xc.clients 是否有缓存的 Client，如果有，检查是否可用状态
-	// 如果是则返回缓存的 Client，如果不可用，则从缓存中删除
-	client, ok := xc.clients[rpcAddr]
-	if ok && !client.IsAvailable() {
+	pool := xc.resizePool(rpcAddr)
+	// 1. 轮询选出连接池中的一个位置，如果有缓存的 Client，检查是否可用状态
+	// 如果是则返回缓存的 Client，如果不可用，则关闭并重新创建
+	i := xc.next[rpcAddr] % len(pool)
+	xc.next[rpcAddr] = i + 1
+	client := pool[i]
+	if client != nil && !client.IsAvailable() {
 		_ = client.Close()
-		delete(xc.clients, rpcAddr)
+		pool[i] = nil
 		client = nil
 	}
 
@@ -79,17 +115,70 @@ func (xc *XClient) dial(rpcAddr string) (*Client, error) {
 		if err != nil {
 			return nil, err
 		}
-		xc.clients[rpcAddr] = client
+		pool[i] = client
 	}
 	return client, nil
 }
 
+// SetRetry sets the retry policy of Call and CallTimed: a call failed by a retriable error,
+// such as a dial error or a connection reset, is retried on another server after wait,
+// the wait doubles after each attempt. maxAttempts includes the first attempt,
+// a value less than 2 disables retrying. Errors returned by the method are never retried.
+func (xc *XClient) SetRetry(maxAttempts int, wait time.Duration) {
+	xc.SetRetryBackoff(maxAttempts, func() backoff.Backoff { return backoff.NewExponential(wait, 0) })
+}
+
+// SetRetryBackoff is like SetRetry, but the waits between attempts are computed by
+// the Backoff returned by newBackoff, which is called once for each call.
+// A nil newBackoff waits 100ms before the second attempt and doubles it after that.
+func (xc *XClient) SetRetryBackoff(maxAttempts int, newBackoff func() backoff.Backoff) {
+	if newBackoff == nil {
+		newBackoff = func() backoff.Backoff { return backoff.NewExponential(defaultRetryWait, 0) }
+	}
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.maxAttempts = maxAttempts
+	xc.newBackoff = newBackoff
+}
+
+// isRetriable reports whether err happened before the request was written,
+// so that it's safe to send it to another one, see notSentError.
+// 请求可能已经被服务端执行的错误（例如等待回复时连接断开、超时）以及服务端方法返回的错误都不会被重试
+func isRetriable(err error) bool {
+	var notSent *notSentError
+	return errors.As(err, &notSent)
+}
+
+// resizePool returns the pool of rpcAddr with poolSize slots, the clients beyond it are closed.
+// must be called with mu held.
+func (xc *XClient) resizePool(rpcAddr string) []*Client {
+	pool := xc.clients[rpcAddr]
+	if len(pool) == xc.poolSize {
+		return pool
+	}
+	for _, client := range pool[min(len(pool), xc.poolSize):] {
+		if client != nil {
+			_ = client.Close()
+		}
+	}
+	resized := make([]*Client, xc.poolSize)
+	copy(resized, pool)
+	xc.clients[rpcAddr] = resized
+	return resized
+}
+
 func (xc *XClient) call(ctx context.Context, rpcAddr, serviceMethod string, args, reply any) error {
+	_, err := xc.callTimed(ctx, rpcAddr, serviceMethod, args, reply)
+	return err
+}
+
+func (xc *XClient) callTimed(ctx context.Context, rpcAddr, serviceMethod string, args, reply any) (time.Duration, error) {
 	rpcClient, err := xc.dial(rpcAddr)
 	if err != nil {
-		return err
+		// 连接或握手失败，请求还没有发出
+		return 0, &notSentError{err}
 	}
-	return rpcClient.Call(ctx, serviceMethod, args, reply)
+	return rpcClient.CallTimed(ctx, serviceMethod, args, reply)
 }
 
 // 负载均衡的请求分发方式
@@ -97,7 +186,58 @@ func (xc *XClient) call(ctx context.Context, rpcAddr, serviceMethod string, args
 // Call 调用指定函数，等待其完成，并返回其错误状态。
 // xc 将选择合适的服务器。
 func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply any) error {
-	serverAddr, err := xc.d.Get(xc.mode)
+	_, err := xc.CallTimed(ctx, serviceMethod, args, reply)
+	return err
+}
+
+// CallTimed is like Call, but also returns the round-trip time of the call.
+// 按照 SetRetry 设置的重试策略，可重试的错误发生后，选择另一台服务器再次调用
+func (xc *XClient) CallTimed(ctx context.Context, serviceMethod string, args, reply any) (time.Duration, error) {
+	xc.mu.Lock()
+	maxAttempts, newBackoff := xc.maxAttempts, xc.newBackoff
+	xc.mu.Unlock()
+
+	var (
+		exclude []string
+		lastErr error
+		waits   backoff.Backoff // created on the first retry
+	)
+	for attempt := 1; ; attempt++ {
+		serverAddr, err := xc.d.GetExcluding(xc.mode, exclude)
+		if err != nil {
+			if lastErr != nil {
+				return 0, lastErr // all servers have failed, the error of the last call is more useful
+			}
+			return 0, err
+		}
+		d, err := xc.callTimed(ctx, serverAddr, serviceMethod, args, reply)
+		if err != nil && maxAttempts >= 2 && isRetriable(err) {
+			// 开启重试时报告给服务发现，一段时间内不再选择这台服务器
+			xc.d.MarkBad(serverAddr, badServerCooldown)
+		}
+		if err == nil || attempt >= maxAttempts || !isRetriable(err) {
+			return d, err
+		}
+		lastErr = err
+		exclude = append(exclude, serverAddr)
+		if waits == nil {
+			waits = newBackoff()
+		}
+		wait := waits.Next()
+		log.Printf("rpc client: call %s on %s failed, retry after %s: %v\n", serviceMethod, serverAddr, wait, err)
+		select {
+		case <-ctx.Done():
+			return 0, err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// CallWithKey is like Call, but the server is selected by the consistent hash of key,
+// so that calls with the same key go to the same server while the servers don't change.
+// 适用于缓存类的服务，调用失败时不会重试其他服务器，以免破坏 key 与服务器的对应关系
+func (xc *XClient) CallWithKey(ctx context.Context, key, serviceMethod string, args, reply any) error {
+	serverAddr, err := xc.d.GetByKey(key)
 	if err != nil {
 		return err
 	}
@@ -106,14 +246,12 @@ func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply a
 
 // 广播：将请求发送到所有服务实例，并等待所有实例的响应。适用于需要确保所有实例处理请求的场景。
 //
-// TODO: 负载均衡概念，实现方式
-//
-// Broadcast 将请求广播到所有的服务实例，如果任意一个实例发生错误，则返回其中一个错误
+// Broadcast 将请求广播到所有的服务实例，如果有实例发生错误，返回 *BroadcastError，包含每个失败实例的错误
 // 如果调用成功，则返回其中一个的结果
 //
 // 1. 为了提升性能，请求是并发的
-// 2. 并发情况下需要使用互斥锁保证 error 和 reply 能被正确赋值
-// 3. 借助 context.WithCancel 确保有错误发生时，快速失败
+// 2. 并发情况下需要使用互斥锁保证 errs 和 reply 能被正确赋值
+// 3. 一个实例失败时不取消其他实例的调用，这样才能知道每个实例各自的结果
 func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, reply any) error {
 	servers, err := xc.d.GetAll()
 	if err != nil {
@@ -121,14 +259,12 @@ func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, re
 	}
 
 	var (
-		wg sync.WaitGroup
-		mu sync.Mutex // protect e and replyDone
-		e  error
+		wg   sync.WaitGroup
+		mu   sync.Mutex // protect errs and replyDone
+		errs = make(map[string]error)
 	)
 
 	replyDone := reply == nil // if reply is nil, don't need to set value
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel() // 确保在方法结束后取消 ctx，避免泄漏
 	for _, rpcAddr := range servers {
 		wg.Add(1)
 		go func(rpcAddr string) {
@@ -139,9 +275,8 @@ func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, re
 			}
 			err := xc.call(ctx, rpcAddr, serviceMethod, args, clonedReply)
 			mu.Lock()
-			if err != nil && e == nil {
-				e = err
-				cancel()
+			if err != nil {
+				errs[rpcAddr] = err
 			}
 			if err == nil && !replyDone {
 				reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(clonedReply).Elem())
@@ -151,5 +286,45 @@ func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, re
 		}(rpcAddr)
 	}
 	wg.Wait()
-	return e
+	if len(errs) > 0 {
+		return &BroadcastError{Errors: errs}
+	}
+	return nil
+}
+
+// BroadcastAll sends the request to all servers like Broadcast, and collects the reply and
+// the error of every server, keyed by server address. Each reply is a pointer to a new value
+// of replyType allocated for its server, e.g. *int for reflect.TypeOf(0).
+// If the servers can't be listed, the error is keyed by the empty address.
+// 与 Broadcast 不同，不会只保留其中一个结果，适用于汇总所有实例健康状态等场景
+func (xc *XClient) BroadcastAll(ctx context.Context, serviceMethod string, args any, replyType reflect.Type) (map[string]any, map[string]error) {
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		return nil, map[string]error{"": err}
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex // protect replies and errs
+		replies = make(map[string]any)
+		errs    = make(map[string]error)
+	)
+	for _, rpcAddr := range servers {
+		wg.Add(1)
+		go func(rpcAddr string) {
+			defer wg.Done()
+			// 每个实例使用单独分配的 reply
+			reply := reflect.New(replyType).Interface()
+			err := xc.call(ctx, rpcAddr, serviceMethod, args, reply)
+			mu.Lock()
+			if err != nil {
+				errs[rpcAddr] = err
+			} else {
+				replies[rpcAddr] = reply
+			}
+			mu.Unlock()
+		}(rpcAddr)
+	}
+	wg.Wait()
+	return replies, errs
 }
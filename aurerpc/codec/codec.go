@@ -10,10 +10,14 @@ package codec
 
 import "io"
 
+// msgpack tag 固定了字段名，非 Go 的对端按这些名字解析 header
 type Header struct {
-	ServiceMethod string // format "Service.Method"
-	Seq           uint64 // sequence number chosen by client
-	Error         string
+	ServiceMethod string            `msgpack:"ServiceMethod"` // format "Service.Method"
+	Seq           uint64            `msgpack:"Seq"`           // sequence number chosen by client
+	Error         string            `msgpack:"Error"`
+	Metadata      map[string]string `msgpack:"Metadata,omitempty"` // values carried along with the request, e.g. a trace id
+	Oneway        bool              `msgpack:"Oneway,omitempty"`   // the client doesn't wait for a reply, the server sends none
+	Deadline      int64             `msgpack:"Deadline,omitempty"` // deadline of the call in unix nanoseconds, 0 means no client deadline
 }
 
 // Codec 对消息体进行编解码的接口，方便实现不同的 codec 实例
@@ -29,13 +33,34 @@ type NewCodecFunc func(io.ReadWriteCloser) Codec
 type Type string
 
 const (
-	GobType  Type = "application/gob"
-	JsonType Type = "application/json" // not implemented
+	GobType     Type = "application/gob"
+	JsonType    Type = "application/json"
+	MsgpackType Type = "application/msgpack"
 )
 
+// NewCodecFuncMap 协议版本 2 起使用的 codec，header 和 body 使用长度前缀分帧
 var NewCodecFuncMap map[Type]NewCodecFunc
 
+// NewStreamCodecFuncMap 协议版本 1 使用的 codec，不分帧，用于兼容旧的客户端和服务端
+var NewStreamCodecFuncMap map[Type]NewCodecFunc
+
 func init() {
 	NewCodecFuncMap = make(map[Type]NewCodecFunc)
 	NewCodecFuncMap[GobType] = NewGobCodec
+	NewCodecFuncMap[JsonType] = NewJsonCodec
+	NewCodecFuncMap[MsgpackType] = NewMsgpackCodec
+
+	NewStreamCodecFuncMap = make(map[Type]NewCodecFunc)
+	NewStreamCodecFuncMap[GobType] = NewGobStreamCodec
+	NewStreamCodecFuncMap[JsonType] = NewJsonStreamCodec
+	NewStreamCodecFuncMap[MsgpackType] = NewMsgpackStreamCodec
+}
+
+// CodecFunc returns the constructor of codec type t for protocol version,
+// nil is returned if t is not supported.
+func CodecFunc(t Type, version uint8) NewCodecFunc {
+	if version < 2 {
+		return NewStreamCodecFuncMap[t]
+	}
+	return NewCodecFuncMap[t]
 }
@@ -0,0 +1,85 @@
+package codec
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+)
+
+// CompressType 连接的压缩方式，在握手时通过 Option 协商
+// 压缩作用于握手之后的整个连接，header 和 body 都会被压缩
+type CompressType string
+
+const (
+	CompressNone   CompressType = "" // default
+	CompressGzip   CompressType = "gzip"
+	CompressSnappy CompressType = "snappy"
+)
+
+// flushWriter is a compressing writer which can flush the buffered data
+type flushWriter interface {
+	io.Writer
+	Flush() error
+}
+
+// compressConn compresses the data written to conn and decompresses the data read from it.
+// 每次 Write 之后都会 Flush，保证对端能够立即解压出完整的报文
+type compressConn struct {
+	conn io.ReadWriteCloser
+	w    flushWriter
+	// 创建 gzip.Reader 时会阻塞读取 gzip 的头部，因此在第一次 Read 时才创建
+	newReader func(io.Reader) (io.Reader, error)
+	r         io.Reader
+}
+
+// WrapCompress wraps conn to compress the data on the wire according to t,
+// conn is returned as is for CompressNone.
+func WrapCompress(conn io.ReadWriteCloser, t CompressType) (io.ReadWriteCloser, error) {
+	switch t {
+	case CompressNone:
+		return conn, nil
+	case CompressGzip:
+		return &compressConn{
+			conn: conn,
+			w:    gzip.NewWriter(conn),
+			newReader: func(r io.Reader) (io.Reader, error) {
+				return gzip.NewReader(r)
+			},
+		}, nil
+	case CompressSnappy:
+		return &compressConn{
+			conn: conn,
+			w:    snappy.NewBufferedWriter(conn),
+			newReader: func(r io.Reader) (io.Reader, error) {
+				return snappy.NewReader(r), nil
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("rpc codec: unsupported compress type %q", t)
+	}
+}
+
+func (c *compressConn) Read(p []byte) (int, error) {
+	if c.r == nil {
+		r, err := c.newReader(c.conn)
+		if err != nil {
+			return 0, err
+		}
+		c.r = r
+	}
+	return c.r.Read(p)
+}
+
+func (c *compressConn) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
+
+func (c *compressConn) Close() error {
+	return c.conn.Close()
+}
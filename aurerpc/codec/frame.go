@@ -0,0 +1,117 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// 分帧：每个 header 和 body 编码后，先写入 4 字节大端序的长度，再写入内容
+// 读取时先读出长度，再读取恰好这么多字节交给解码器，解码器不会读到下一个报文的内容
+// |len(4)|header|len(4)|body|len(4)|header|len(4)|body|...
+//
+// 开启校验和后（见 EnableChecksum），每一帧的内容之后再写入 4 字节大端序的 CRC32（IEEE），长度不包含校验和
+// |len(4)|header|crc(4)|len(4)|body|crc(4)|...
+
+// MaxFrameSize is the max length of a frame, a larger frame is treated as corrupted
+const MaxFrameSize = 64 << 20
+
+// ErrChecksumMismatch is returned when the checksum of a frame doesn't match its content
+var ErrChecksumMismatch = errors.New("rpc codec: checksum mismatch")
+
+// checksumCodec is implemented by the codecs which support checksums
+type checksumCodec interface {
+	enableChecksum() error
+}
+
+// EnableChecksum makes c append a CRC32 checksum to each frame it writes and verify it on read,
+// both peers must enable it. Only framed codecs (protocol version 2) support checksums.
+func EnableChecksum(c Codec) error {
+	cc, ok := c.(checksumCodec)
+	if !ok {
+		return fmt.Errorf("rpc codec: %T doesn't support checksums", c)
+	}
+	return cc.enableChecksum()
+}
+
+// errChecksumStream is returned by enableChecksum of the codecs without framing
+var errChecksumStream = errors.New("rpc codec: checksums require framing (protocol version 2)")
+
+// writeFrame writes the length of data and data to w, followed by the checksum of data if checksum is set
+func writeFrame(w io.Writer, data []byte, checksum bool) error {
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], uint32(len(data)))
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if !checksum {
+		return nil
+	}
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(data))
+	_, err := w.Write(sum[:])
+	return err
+}
+
+// frameHeader is the placeholder of the length prefix, see beginFrame
+var frameHeader [4]byte
+
+// beginFrame resets buf and reserves the length prefix at its beginning,
+// the content of the frame is then written to buf directly.
+// 与 writeFrame 相比，长度前缀和内容在同一块内存中，只需要一次写入，也没有额外的内存分配
+func beginFrame(buf *bytes.Buffer) {
+	buf.Reset()
+	buf.Write(frameHeader[:])
+}
+
+// endFrame fills the length prefix reserved by beginFrame, appends the checksum
+// of the content if checksum is set, and returns the whole frame
+func endFrame(buf *bytes.Buffer, checksum bool) []byte {
+	frame := buf.Bytes()
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-len(frameHeader)))
+	if checksum {
+		var sum [4]byte
+		binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(frame[len(frameHeader):]))
+		buf.Write(sum[:])
+		frame = buf.Bytes()
+	}
+	return frame
+}
+
+// readFrame reads a frame written by writeFrame from r, the checksum is verified if checksum is set
+func readFrame(r io.Reader, checksum bool) ([]byte, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(prefix[:])
+	if n > MaxFrameSize {
+		return nil, fmt.Errorf("rpc codec: frame of %d bytes exceeds the max size %d", n, MaxFrameSize)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if checksum {
+		var sum [4]byte
+		if _, err := io.ReadFull(r, sum[:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if binary.BigEndian.Uint32(sum[:]) != crc32.ChecksumIEEE(data) {
+			return nil, ErrChecksumMismatch
+		}
+	}
+	return data, nil
+}
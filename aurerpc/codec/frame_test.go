@@ -0,0 +1,42 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestChecksum(t *testing.T) {
+	for name, newCodec := range map[string]NewCodecFunc{"gob": NewGobCodec, "json": NewJsonCodec, "msgpack": NewMsgpackCodec} {
+		t.Run(name, func(t *testing.T) {
+			conn := new(bufferConn)
+			c := newCodec(conn)
+			if err := EnableChecksum(c); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1}, "hello checksum"); err != nil {
+				t.Fatal(err)
+			}
+			// 翻转 body 帧内容中的一个字节：跳过 header 帧（长度 + 内容 + 校验和）和 body 帧的长度
+			data := conn.Bytes()
+			bodyStart := 4 + int(binary.BigEndian.Uint32(data)) + 4 + 4
+			if bodyStart > len(data)-5 {
+				t.Fatalf("flipped byte is not in the body frame")
+			}
+			data[len(data)-5] ^= 0xff
+
+			var h Header
+			if err := c.ReadHeader(&h); err != nil || h.Seq != 1 {
+				t.Fatalf("header should be intact: %+v %v", h, err)
+			}
+			var body string
+			if err := c.ReadBody(&body); !errors.Is(err, ErrChecksumMismatch) {
+				t.Fatalf("expect ErrChecksumMismatch, got %v (body %q)", err, body)
+			}
+		})
+	}
+
+	if err := EnableChecksum(NewGobStreamCodec(new(bufferConn))); err == nil {
+		t.Fatal("checksums should require framing")
+	}
+}
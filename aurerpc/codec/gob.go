@@ -2,6 +2,7 @@ package codec
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/gob"
 	"io"
 	"log"
@@ -12,11 +13,18 @@ import (
 // conn 通过 TCP/Unix 建立 socket 时得到的连接实例
 // dec, enc 对应 gob 的 Decoder 和 Encoder
 // buf 为了防止阻塞而创建的带缓冲的 Writer
+// framed 为 true 时，每个 header 和 body 使用长度前缀分帧，见 frame.go
+// 分帧时 enc 编码到 encBuf 中，再整体写入一帧；读取的帧放入 decBuf 中交给 dec 解码
 type GobCodec struct {
-	conn io.ReadWriteCloser
-	buf  *bufio.Writer
-	dec  *gob.Decoder
-	enc  *gob.Encoder
+	conn   io.ReadWriteCloser
+	buf    *bufio.Writer
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	framed bool
+	encBuf *bytes.Buffer
+	decBuf *bytes.Buffer
+	// checksum 为 true 时每一帧带有 CRC32 校验和，见 EnableChecksum
+	checksum bool
 }
 
 // 确保 GobCodec 实现了 Codec 接口
@@ -26,7 +34,23 @@ type GobCodec struct {
 // 一行保护性代码
 var _ Codec = (*GobCodec)(nil)
 
+// NewGobCodec returns a gob codec with length-prefixed frames
 func NewGobCodec(conn io.ReadWriteCloser) Codec {
+	c := &GobCodec{
+		conn:   conn,
+		buf:    bufio.NewWriter(conn),
+		framed: true,
+		encBuf: new(bytes.Buffer),
+		decBuf: new(bytes.Buffer),
+	}
+	c.enc = gob.NewEncoder(c.encBuf)
+	c.dec = gob.NewDecoder(c.decBuf)
+	return c
+}
+
+// NewGobStreamCodec returns a gob codec without framing,
+// it is used by peers speaking protocol version 1.
+func NewGobStreamCodec(conn io.ReadWriteCloser) Codec {
 	buf := bufio.NewWriter(conn)
 	return &GobCodec{
 		conn: conn,
@@ -42,14 +66,37 @@ func NewGobCodec(conn io.ReadWriteCloser) Codec {
 // Solution:
 // 1. 两次握手，在服务端收到这个 opt 后，将这个 opt 发送给客户端验证
 // 2. 确定 opt 长度，在发送 opt 之前，发送 opt 的 len
+//
+// 协议版本 2 起 header 和 body 都使用长度前缀分帧，解码器只会读取当前帧的内容
 func (c *GobCodec) ReadHeader(h *Header) error {
+	if err := c.nextFrame(); err != nil {
+		return err
+	}
 	return c.dec.Decode(h)
 }
 
 func (c *GobCodec) ReadBody(body any) error {
+	if err := c.nextFrame(); err != nil {
+		return err
+	}
+	// body 为 nil 时也要解码，帧中可能包含 gob 的类型定义
 	return c.dec.Decode(body)
 }
 
+// nextFrame reads the next frame into decBuf if the codec is framed
+func (c *GobCodec) nextFrame() error {
+	if !c.framed {
+		return nil
+	}
+	data, err := readFrame(c.conn, c.checksum)
+	if err != nil {
+		return err
+	}
+	c.decBuf.Reset()
+	c.decBuf.Write(data)
+	return nil
+}
+
 func (c *GobCodec) Write(h *Header, body any) (err error) {
 	defer func() {
 		_ = c.buf.Flush()
@@ -58,17 +105,39 @@ func (c *GobCodec) Write(h *Header, body any) (err error) {
 		}
 	}()
 
-	if err := c.enc.Encode(h); err != nil {
+	if err := c.encode(h); err != nil {
 		log.Println("rpc codec: gob error encoding header:", err)
 		return err
 	}
-	if err := c.enc.Encode(body); err != nil {
+	if err := c.encode(body); err != nil {
 		log.Println("rpc codec: gob error encoding body:", err)
 		return err
 	}
 	return nil
 }
 
+// encode encodes v, and writes it as a frame if the codec is framed
+func (c *GobCodec) encode(v any) error {
+	if !c.framed {
+		return c.enc.Encode(v)
+	}
+	// 直接编码到预留了长度前缀的 encBuf 中，整帧一次写入 buf
+	beginFrame(c.encBuf)
+	if err := c.enc.Encode(v); err != nil {
+		return err
+	}
+	_, err := c.buf.Write(endFrame(c.encBuf, c.checksum))
+	return err
+}
+
+func (c *GobCodec) enableChecksum() error {
+	if !c.framed {
+		return errChecksumStream
+	}
+	c.checksum = true
+	return nil
+}
+
 func (c *GobCodec) Close() error {
 	return c.conn.Close()
 }
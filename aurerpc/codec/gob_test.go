@@ -0,0 +1,89 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// discardConn drops everything written to it
+type discardConn struct{}
+
+func (discardConn) Read([]byte) (int, error)    { return 0, io.EOF }
+func (discardConn) Write(p []byte) (int, error) { return len(p), nil }
+func (discardConn) Close() error                { return nil }
+
+// bufferConn reads what has been written to it
+type bufferConn struct{ bytes.Buffer }
+
+func (*bufferConn) Close() error { return nil }
+
+func TestGobCodecFrames(t *testing.T) {
+	conn := new(bufferConn)
+	c := NewGobCodec(conn)
+	for i := range 3 {
+		if err := c.Write(&Header{ServiceMethod: "Foo.List", Seq: uint64(i)}, []int{i, i + 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 每一帧以 4 字节大端序的长度开头
+	n := binary.BigEndian.Uint32(conn.Bytes())
+	if int(n) > conn.Len()-4 {
+		t.Fatalf("bad length prefix %d of %d bytes", n, conn.Len())
+	}
+	for i := range 3 {
+		var h Header
+		var body []int
+		if err := c.ReadHeader(&h); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.ReadBody(&body); err != nil {
+			t.Fatal(err)
+		}
+		if h.Seq != uint64(i) || !reflect.DeepEqual(body, []int{i, i + 1}) {
+			t.Fatalf("unexpected message %d: %+v %v", i, h, body)
+		}
+	}
+	if conn.Len() != 0 {
+		t.Fatalf("%d bytes left unread", conn.Len())
+	}
+}
+
+type benchItem struct {
+	ID    int
+	Name  string
+	Score float64
+}
+
+func benchmarkGobWrite(b *testing.B, newCodec NewCodecFunc, body any) {
+	c := newCodec(discardConn{})
+	h := &Header{ServiceMethod: "Foo.List"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.Seq = uint64(i)
+		if err := c.Write(h, body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGobWriteInts(b *testing.B) {
+	reply := make([]int, 100_000)
+	for i := range reply {
+		reply[i] = i
+	}
+	b.Run("framed", func(b *testing.B) { benchmarkGobWrite(b, NewGobCodec, reply) })
+	b.Run("stream", func(b *testing.B) { benchmarkGobWrite(b, NewGobStreamCodec, reply) })
+}
+
+func BenchmarkGobWriteStructs(b *testing.B) {
+	reply := make([]benchItem, 100_000)
+	for i := range reply {
+		reply[i] = benchItem{ID: i, Name: "item", Score: float64(i) / 3}
+	}
+	b.Run("framed", func(b *testing.B) { benchmarkGobWrite(b, NewGobCodec, reply) })
+	b.Run("stream", func(b *testing.B) { benchmarkGobWrite(b, NewGobStreamCodec, reply) })
+}
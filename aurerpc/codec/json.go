@@ -0,0 +1,111 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+)
+
+// JsonCodec 使用 JSON 编码 header 和 body，便于其他语言的客户端接入
+// framed 为 true 时，每个 header 和 body 使用长度前缀分帧，见 frame.go
+// 否则 header 和 body 依次作为两个 JSON 值写入连接
+type JsonCodec struct {
+	conn   io.ReadWriteCloser
+	buf    *bufio.Writer
+	dec    *json.Decoder // only used without framing
+	enc    *json.Encoder // only used without framing
+	framed bool
+	// checksum 为 true 时每一帧带有 CRC32 校验和，见 EnableChecksum
+	checksum bool
+}
+
+var _ Codec = (*JsonCodec)(nil)
+
+// NewJsonCodec returns a json codec with length-prefixed frames
+func NewJsonCodec(conn io.ReadWriteCloser) Codec {
+	return &JsonCodec{
+		conn:   conn,
+		buf:    bufio.NewWriter(conn),
+		framed: true,
+	}
+}
+
+// NewJsonStreamCodec returns a json codec without framing,
+// it is used by peers speaking protocol version 1.
+func NewJsonStreamCodec(conn io.ReadWriteCloser) Codec {
+	buf := bufio.NewWriter(conn)
+	return &JsonCodec{
+		conn: conn,
+		buf:  buf,
+		dec:  json.NewDecoder(conn),
+		enc:  json.NewEncoder(buf),
+	}
+}
+
+func (c *JsonCodec) ReadHeader(h *Header) error {
+	return c.decode(h)
+}
+
+// ReadBody decodes the body into body, the body is discarded if body is nil
+func (c *JsonCodec) ReadBody(body any) error {
+	return c.decode(body)
+}
+
+func (c *JsonCodec) decode(v any) error {
+	if c.framed {
+		data, err := readFrame(c.conn, c.checksum)
+		if err != nil || v == nil {
+			return err
+		}
+		return json.Unmarshal(data, v)
+	}
+	if v == nil {
+		// 与 gob 不同，json 不能 Decode(nil)，读入 RawMessage 后丢弃
+		var discard json.RawMessage
+		return c.dec.Decode(&discard)
+	}
+	return c.dec.Decode(v)
+}
+
+func (c *JsonCodec) Write(h *Header, body any) (err error) {
+	defer func() {
+		_ = c.buf.Flush()
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+
+	if err := c.encode(h); err != nil {
+		log.Println("rpc codec: json error encoding header:", err)
+		return err
+	}
+	if err := c.encode(body); err != nil {
+		log.Println("rpc codec: json error encoding body:", err)
+		return err
+	}
+	return nil
+}
+
+func (c *JsonCodec) encode(v any) error {
+	if !c.framed {
+		return c.enc.Encode(v)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFrame(c.buf, data, c.checksum)
+}
+
+func (c *JsonCodec) enableChecksum() error {
+	if !c.framed {
+		return errChecksumStream
+	}
+	c.checksum = true
+	return nil
+}
+
+func (c *JsonCodec) Close() error {
+	return c.conn.Close()
+}
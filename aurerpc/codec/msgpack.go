@@ -0,0 +1,110 @@
+package codec
+
+import (
+	"bufio"
+	"io"
+	"log"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MsgpackCodec 使用 MessagePack 编码 header 和 body，便于与 Python 等其他语言的服务互通
+// header 按 Header 中 msgpack tag 指定的字段名编码为 map
+// framed 为 true 时，每个 header 和 body 使用长度前缀分帧，见 frame.go
+type MsgpackCodec struct {
+	conn   io.ReadWriteCloser
+	buf    *bufio.Writer
+	dec    *msgpack.Decoder // only used without framing
+	enc    *msgpack.Encoder // only used without framing
+	framed bool
+	// checksum 为 true 时每一帧带有 CRC32 校验和，见 EnableChecksum
+	checksum bool
+}
+
+var _ Codec = (*MsgpackCodec)(nil)
+
+// NewMsgpackCodec returns a msgpack codec with length-prefixed frames
+func NewMsgpackCodec(conn io.ReadWriteCloser) Codec {
+	return &MsgpackCodec{
+		conn:   conn,
+		buf:    bufio.NewWriter(conn),
+		framed: true,
+	}
+}
+
+// NewMsgpackStreamCodec returns a msgpack codec without framing,
+// it is used by peers speaking protocol version 1.
+func NewMsgpackStreamCodec(conn io.ReadWriteCloser) Codec {
+	buf := bufio.NewWriter(conn)
+	return &MsgpackCodec{
+		conn: conn,
+		buf:  buf,
+		dec:  msgpack.NewDecoder(conn),
+		enc:  msgpack.NewEncoder(buf),
+	}
+}
+
+func (c *MsgpackCodec) ReadHeader(h *Header) error {
+	return c.decode(h)
+}
+
+// ReadBody decodes the body into body, the body is discarded if body is nil
+func (c *MsgpackCodec) ReadBody(body any) error {
+	return c.decode(body)
+}
+
+func (c *MsgpackCodec) decode(v any) error {
+	if c.framed {
+		data, err := readFrame(c.conn, c.checksum)
+		if err != nil || v == nil {
+			return err
+		}
+		return msgpack.Unmarshal(data, v)
+	}
+	if v == nil {
+		return c.dec.Skip()
+	}
+	return c.dec.Decode(v)
+}
+
+func (c *MsgpackCodec) Write(h *Header, body any) (err error) {
+	defer func() {
+		_ = c.buf.Flush()
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+
+	if err := c.encode(h); err != nil {
+		log.Println("rpc codec: msgpack error encoding header:", err)
+		return err
+	}
+	if err := c.encode(body); err != nil {
+		log.Println("rpc codec: msgpack error encoding body:", err)
+		return err
+	}
+	return nil
+}
+
+func (c *MsgpackCodec) encode(v any) error {
+	if !c.framed {
+		return c.enc.Encode(v)
+	}
+	data, err := msgpack.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFrame(c.buf, data, c.checksum)
+}
+
+func (c *MsgpackCodec) enableChecksum() error {
+	if !c.framed {
+		return errChecksumStream
+	}
+	c.checksum = true
+	return nil
+}
+
+func (c *MsgpackCodec) Close() error {
+	return c.conn.Close()
+}
@@ -4,4 +4,8 @@ const (
 	Connected        = "200 Connected to Aure RPC"
 	DefaultRPCPath   = "/_aurerpc_"
 	DefaultDebugPath = "/debug/aurerpc"
+	// DefaultMetricsPath serves the metrics of the methods as JSON
+	DefaultMetricsPath = DefaultDebugPath + "/metrics.json"
+	// DefaultInflightPath lists the requests being handled, append ".json" for JSON
+	DefaultInflightPath = DefaultDebugPath + "/inflight"
 )
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"math"
 	"math/rand"
+	"slices"
 	"sync"
 	"time"
 )
@@ -13,6 +14,14 @@ type SelectMode int
 const (
 	RandomSelect SelectMode = iota
 	RoundRobinSelect
+	// FailoverSelect 一直返回同一个主服务器，直到它被 MarkBad 标记为不健康，再切换到下一个
+	FailoverSelect
+	// WeightedRoundRobinSelect 按照权重分配请求，使用平滑加权轮询，权重见 NewWeightedDiscovery
+	WeightedRoundRobinSelect
+	// ConsistentHashSelect 按照 key 的一致性哈希选择服务器，需要使用 GetByKey，Get 不支持这种模式
+	ConsistentHashSelect
+	// WeightedRandomSelect 每次独立地按照权重随机选择服务器，权重见 NewWeightedDiscovery
+	WeightedRandomSelect
 )
 
 // interface 类型，包含了服务发现所需要的接口
@@ -21,6 +30,12 @@ type Discovery interface {
 	Update(servers []string) error       // 手动更新服务列表
 	Get(mode SelectMode) (string, error) // 根据负载均衡策略，选择一个服务实例，返回一个服务器地址
 	GetAll() ([]string, error)           // 返回所有的服务实例
+	// 与 Get 相同，但不会选择 exclude 中的服务实例，用于重试时避开失败的服务器
+	GetExcluding(mode SelectMode, exclude []string) (string, error)
+	// 标记服务实例不健康，cooldown 时间内选择服务器时跳过它，由客户端在调用失败时报告
+	MarkBad(addr string, cooldown time.Duration)
+	// 根据 key 的一致性哈希选择服务实例，同一个 key 总是映射到同一台服务器，直到服务列表发生变化
+	GetByKey(key string) (string, error)
 }
 
 // r 是一个生产随机数的实例，初始化时使用时间戳设定随机数种子，避免每次产生相同的随机数序列
@@ -35,9 +50,19 @@ type MultiServerDiscovery struct {
 	r       *rand.Rand   // generate random number
 	mu      sync.RWMutex // protect following
 	servers []string
-	index   int // record the selected position for robin algorithm
+	index   int                  // record the selected position for robin algorithm
+	bad     map[string]time.Time // servers marked by MarkBad and the time until they are skipped
+	primary string               // server selected by FailoverSelect
+	weights map[string]int       // weights of servers for the weighted modes, 1 if absent
+	current map[string]int       // current weights of smooth weighted round robin
+	ring    *HashRing            // ring of ConsistentHashSelect, built from ringServers
+	// servers the ring is built from, the ring is rebuilt once servers differ from it
+	ringServers []string
 }
 
+// ringReplicas is the number of virtual nodes per server on the ring of GetByKey
+const ringReplicas = 50
+
 func NewMultiServerDiscovery(servers []string) *MultiServerDiscovery {
 	d := &MultiServerDiscovery{
 		servers: servers,
@@ -47,6 +72,23 @@ func NewMultiServerDiscovery(servers []string) *MultiServerDiscovery {
 	return d
 }
 
+// NewWeightedDiscovery creates a MultiServerDiscovery whose servers have weights,
+// weights are used by WeightedRoundRobinSelect and WeightedRandomSelect, a weight less than 1 is treated as 1.
+func NewWeightedDiscovery(weights map[string]int) *MultiServerDiscovery {
+	servers := make([]string, 0, len(weights))
+	for server := range weights {
+		servers = append(servers, server)
+	}
+	// map 的遍历顺序是随机的，排序后 RoundRobinSelect 等模式的顺序是确定的
+	slices.Sort(servers)
+	d := NewMultiServerDiscovery(servers)
+	d.weights = make(map[string]int, len(weights))
+	for server, weight := range weights {
+		d.weights[server] = max(weight, 1)
+	}
+	return d
+}
+
 var _ Discovery = (*MultiServerDiscovery)(nil)
 
 // Refresh doesn't make sense for MultiServerDiscovery, so ignore it
@@ -67,23 +109,168 @@ func (d *MultiServerDiscovery) Update(servers []string) error {
 func (d *MultiServerDiscovery) Get(mode SelectMode) (string, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	n := len(d.servers)
+	return d.selectServer(mode, d.servers)
+}
+
+// GetExcluding gets a server according to mode which is not in exclude,
+// an error is returned if no server remains.
+func (d *MultiServerDiscovery) GetExcluding(mode SelectMode, exclude []string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(exclude) == 0 {
+		return d.selectServer(mode, d.servers)
+	}
+	candidates := make([]string, 0, len(d.servers))
+	for _, server := range d.servers {
+		if !slices.Contains(exclude, server) {
+			candidates = append(candidates, server)
+		}
+	}
+	return d.selectServer(mode, candidates)
+}
+
+// MarkBad skips addr when selecting a server until cooldown has passed
+func (d *MultiServerDiscovery) MarkBad(addr string, cooldown time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.bad == nil {
+		d.bad = make(map[string]time.Time)
+	}
+	d.bad[addr] = time.Now().Add(cooldown)
+}
+
+// healthy returns the servers not marked bad, d.mu must be held.
+// 所有服务器都被标记时返回全部服务器，标记只是建议，总比没有服务器可用要好
+func (d *MultiServerDiscovery) healthy(servers []string) []string {
+	if len(d.bad) == 0 {
+		return servers
+	}
+	now := time.Now()
+	result := make([]string, 0, len(servers))
+	for _, server := range servers {
+		if until, ok := d.bad[server]; ok {
+			if now.Before(until) {
+				continue
+			}
+			delete(d.bad, server) // cooldown has passed
+		}
+		result = append(result, server)
+	}
+	if len(result) == 0 {
+		return servers
+	}
+	return result
+}
+
+// selectServer selects one of servers according to mode, d.mu must be held
+func (d *MultiServerDiscovery) selectServer(mode SelectMode, servers []string) (string, error) {
+	servers = d.healthy(servers)
+	n := len(servers)
 	if n == 0 {
 		return "", errors.New("rpc discovery: no available servers")
 	}
 
 	switch mode {
 	case RandomSelect:
-		return d.servers[d.r.Intn(n)], nil
+		return servers[d.r.Intn(n)], nil
 	case RoundRobinSelect:
-		s := d.servers[d.index%n] // servers could be updated, so mode n to ensure safety
+		s := servers[d.index%n] // servers could be updated, so mode n to ensure safety
 		d.index = (d.index + 1) % n
 		return s, nil
+	case FailoverSelect:
+		return d.failover(servers), nil
+	case WeightedRoundRobinSelect:
+		return d.weightedRoundRobin(servers), nil
+	case WeightedRandomSelect:
+		return d.weightedRandom(servers), nil
+	case ConsistentHashSelect:
+		return "", errors.New("rpc discovery: ConsistentHashSelect requires a key, use GetByKey")
 	default:
 		return "", errors.New("rpc discovery: no support select mode")
 	}
 }
 
+// GetByKey gets the server that key is mapped to by consistent hashing
+func (d *MultiServerDiscovery) GetByKey(key string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.servers) == 0 {
+		return "", errors.New("rpc discovery: no available servers")
+	}
+	// servers 可能被 Update 或者 Refresh 修改，变化后重建哈希环
+	if d.ring == nil || !slices.Equal(d.ringServers, d.servers) {
+		d.ringServers = slices.Clone(d.servers)
+		d.ring = NewHashRing(ringReplicas, nil)
+		d.ring.Add(d.ringServers...)
+	}
+	return d.ring.Get(key), nil
+}
+
+// weightedRoundRobin selects one of servers by smooth weighted round robin, d.mu must be held.
+// 每次选择时，每个服务器的当前权重加上它的权重，选出当前权重最大的服务器，再将它的当前权重减去总权重
+// 例如权重 {a:5, b:1, c:1} 时，7 次选择的结果为 a a b a c a a，请求不会集中在一起
+func (d *MultiServerDiscovery) weightedRoundRobin(servers []string) string {
+	if d.current == nil {
+		d.current = make(map[string]int)
+	}
+	total, best := 0, ""
+	for _, server := range servers {
+		weight := d.weight(server)
+		total += weight
+		d.current[server] += weight
+		if best == "" || d.current[server] > d.current[best] {
+			best = server
+		}
+	}
+	d.current[best] -= total
+	return best
+}
+
+// weightedRandom selects one of servers randomly, the probability of a server is
+// proportional to its weight, d.mu must be held.
+// 与 weightedRoundRobin 不同，每次选择相互独立，只在大量选择后按权重分布
+func (d *MultiServerDiscovery) weightedRandom(servers []string) string {
+	total := 0
+	for _, server := range servers {
+		total += d.weight(server)
+	}
+	n := d.r.Intn(total)
+	for _, server := range servers {
+		if n -= d.weight(server); n < 0 {
+			return server
+		}
+	}
+	return servers[len(servers)-1]
+}
+
+// weight returns the weight of server, 1 if it has none
+func (d *MultiServerDiscovery) weight(server string) int {
+	if w, ok := d.weights[server]; ok {
+		return w
+	}
+	return 1
+}
+
+// failover returns the primary server if it is one of candidates,
+// otherwise the next candidate after it in d.servers becomes the primary, d.mu must be held.
+func (d *MultiServerDiscovery) failover(candidates []string) string {
+	if slices.Contains(candidates, d.primary) {
+		return d.primary
+	}
+	// 主服务器不可用时，按照 d.servers 中的顺序切换到它之后的第一个候选服务器
+	pos := slices.Index(d.servers, d.primary)
+	for i := 1; i <= len(d.servers); i++ {
+		server := d.servers[(pos+i)%len(d.servers)]
+		if slices.Contains(candidates, server) {
+			d.primary = server
+			return server
+		}
+	}
+	// candidates 不在 d.servers 中，只可能是 servers 被并发更新了
+	d.primary = candidates[0]
+	return d.primary
+}
+
 // returns all servers in discovery
 func (d *MultiServerDiscovery) GetAll() ([]string, error) {
 	d.mu.RLock()
@@ -93,3 +280,15 @@ func (d *MultiServerDiscovery) GetAll() ([]string, error) {
 	copy(servers, d.servers)
 	return servers, nil
 }
+
+// Size returns the number of servers in discovery
+func (d *MultiServerDiscovery) Size() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return len(d.servers)
+}
+
+// IsEmpty reports whether there is no server in discovery
+func (d *MultiServerDiscovery) IsEmpty() bool {
+	return d.Size() == 0
+}
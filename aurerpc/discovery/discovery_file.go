@@ -0,0 +1,140 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// FileDiscovery 从本地文件中读取服务列表，适用于没有注册中心的简单部署
+// 文件格式支持两种：
+// 1. 每行一个服务地址，空行和以 # 开头的行会被忽略
+// 2. JSON 字符串数组，例如 ["tcp@10.0.0.1:9999", "http@10.0.0.2:7001"]
+//
+// FileDiscovery is a discovery backed by a static file, the file is
+// re-read on Refresh whenever it has been modified.
+// A missing or malformed file keeps the last good server list.
+type FileDiscovery struct {
+	*MultiServerDiscovery
+	path    string    // path of the server list file
+	modTime time.Time // modification time of the last loaded file
+	size    int64     // size of the last loaded file
+}
+
+func NewFileDiscovery(path string) *FileDiscovery {
+	d := &FileDiscovery{
+		MultiServerDiscovery: NewMultiServerDiscovery(make([]string, 0)),
+		path:                 path,
+	}
+	if err := d.Refresh(); err != nil {
+		log.Printf("[RPC discovery] load servers from file %s failed: %v", path, err)
+	}
+	return d
+}
+
+var _ Discovery = (*FileDiscovery)(nil)
+
+// Refresh 文件发生变化时重新读取服务列表
+// 文件不存在或者格式错误时返回错误，但保留上一次成功读取的服务列表
+func (d *FileDiscovery) Refresh() error {
+	info, err := os.Stat(d.path)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// 1. 文件没有变化，无需重新读取
+	if info.ModTime().Equal(d.modTime) && info.Size() == d.size {
+		return nil
+	}
+
+	// 2. 读取并解析文件
+	data, err := os.ReadFile(d.path)
+	if err != nil {
+		return err
+	}
+	servers, err := parseServerList(data)
+	if err != nil {
+		return fmt.Errorf("rpc discovery: malformed server file %s: %w", d.path, err)
+	}
+
+	// 3. 解析成功后才替换服务列表
+	d.servers = servers
+	d.modTime = info.ModTime()
+	d.size = info.Size()
+	log.Printf("[RPC discovery] refresh discovery from file %s success, servers: %v", d.path, d.servers)
+	return nil
+}
+
+func (d *FileDiscovery) Get(mode SelectMode) (string, error) {
+	// 刷新失败时继续使用上一次的服务列表
+	if err := d.Refresh(); err != nil {
+		log.Printf("[RPC discovery] refresh discovery from file %s failed, keep the last servers: %v", d.path, err)
+	}
+	return d.MultiServerDiscovery.Get(mode)
+}
+
+func (d *FileDiscovery) GetExcluding(mode SelectMode, exclude []string) (string, error) {
+	if err := d.Refresh(); err != nil {
+		log.Printf("[RPC discovery] refresh discovery from file %s failed, keep the last servers: %v", d.path, err)
+	}
+	return d.MultiServerDiscovery.GetExcluding(mode, exclude)
+}
+
+func (d *FileDiscovery) GetByKey(key string) (string, error) {
+	if err := d.Refresh(); err != nil {
+		log.Printf("[RPC discovery] refresh discovery from file %s failed, keep the last servers: %v", d.path, err)
+	}
+	return d.MultiServerDiscovery.GetByKey(key)
+}
+
+func (d *FileDiscovery) GetAll() ([]string, error) {
+	if err := d.Refresh(); err != nil {
+		log.Printf("[RPC discovery] refresh discovery from file %s failed, keep the last servers: %v", d.path, err)
+	}
+	return d.MultiServerDiscovery.GetAll()
+}
+
+// Size returns the number of servers after reloading the file if it changed
+func (d *FileDiscovery) Size() int {
+	if err := d.Refresh(); err != nil {
+		log.Printf("[RPC discovery] refresh discovery from file %s failed, keep the last servers: %v", d.path, err)
+	}
+	return d.MultiServerDiscovery.Size()
+}
+
+func (d *FileDiscovery) IsEmpty() bool {
+	return d.Size() == 0
+}
+
+// parseServerList parses either a JSON array of addresses
+// or newline separated addresses.
+// every address must be in the format of protocol@addr.
+func parseServerList(data []byte) ([]string, error) {
+	content := strings.TrimSpace(string(data))
+	var entries []string
+	if strings.HasPrefix(content, "[") {
+		if err := json.Unmarshal([]byte(content), &entries); err != nil {
+			return nil, err
+		}
+	} else {
+		entries = strings.Split(content, "\n")
+	}
+
+	servers := make([]string, 0, len(entries))
+	for _, s := range entries {
+		s = strings.TrimSpace(s)
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		if strings.Count(s, "@") != 1 {
+			return nil, fmt.Errorf("wrong format '%s', expect protocol@address", s)
+		}
+		servers = append(servers, s)
+	}
+	return servers, nil
+}
@@ -0,0 +1,60 @@
+package discovery
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func _assert(condition bool, msg string, v ...any) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+// writeServerFile writes content and bumps the modification time,
+// so that a refresh always notices the change.
+func writeServerFile(t *testing.T, path, content string, mtime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileDiscovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "servers")
+	now := time.Now()
+	writeServerFile(t, path, "# rpc servers\ntcp@127.0.0.1:9001\n\ntcp@127.0.0.1:9002\n", now)
+
+	d := NewFileDiscovery(path)
+	servers, _ := d.GetAll()
+	_assert(reflect.DeepEqual(servers, []string{"tcp@127.0.0.1:9001", "tcp@127.0.0.1:9002"}),
+		"wrong servers from newline file: %v", servers)
+
+	t.Run("reload json", func(t *testing.T) {
+		writeServerFile(t, path, `["tcp@127.0.0.1:9003"]`, now.Add(time.Second))
+		_assert(d.Refresh() == nil, "refresh should succeed")
+		servers, _ := d.GetAll()
+		_assert(reflect.DeepEqual(servers, []string{"tcp@127.0.0.1:9003"}), "servers should be reloaded: %v", servers)
+	})
+
+	t.Run("malformed keeps last list", func(t *testing.T) {
+		writeServerFile(t, path, `["tcp@127.0.0.1:9004"`, now.Add(2*time.Second))
+		_assert(d.Refresh() != nil, "expect a malformed file error")
+		addr, err := d.Get(RoundRobinSelect)
+		_assert(err == nil && addr == "tcp@127.0.0.1:9003", "expect the last good server, got %s %v", addr, err)
+	})
+
+	t.Run("missing keeps last list", func(t *testing.T) {
+		_ = os.Remove(path)
+		_assert(d.Refresh() != nil, "expect a missing file error")
+		servers, _ := d.GetAll()
+		_assert(reflect.DeepEqual(servers, []string{"tcp@127.0.0.1:9003"}), "expect the last good servers: %v", servers)
+	})
+}
@@ -1,9 +1,14 @@
 package discovery
 
 import (
+	"aurerpc/backoff"
 	"aurerpc/register"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -13,12 +18,38 @@ type RegistryDiscovery struct {
 	registry   string        // registry address
 	timeout    time.Duration // timeout for service registration
 	lastUpdate time.Time     // last update servers list time from registry
+	// 连续刷新失败的次数，以及下一次允许刷新的时间，注册中心不可用时避免每次 Get 都请求它
+	failures  int
+	nextRetry time.Time
+	backoff   backoff.Backoff // waits after failed refreshes, see SetRefreshBackoff
+	// 只从 header 中读取地址列表，兼容不返回 JSON 的旧注册中心，见 SetPlainList
+	plainList bool
+	metadata  map[string]map[string]string // metadata of the servers advertised in heartbeats
+	version   uint64                       // version of the servers in the registry, used by Watch
+	maxStale  time.Duration                // see SetMaxStaleness
+	// 请求注册中心使用的 HTTP 客户端，带有超时，注册中心卡住时刷新不会一直阻塞
+	httpClient *http.Client
+	refreshing chan struct{} // closed once the refresh in progress is done, nil if there is none
+	refreshErr error         // error of the last refresh
 }
 
 const (
 	defaultUpdateTimeout = 10 * time.Second
+	// defaultRegistryTimeout bounds a refresh request to the registry, including dialing
+	defaultRegistryTimeout = 5 * time.Second
+	// 连续刷新失败后默认的退避时间，从 minRefreshBackoff 开始每次翻倍，最多为 maxRefreshBackoff
+	minRefreshBackoff = time.Second
+	maxRefreshBackoff = time.Minute
+	// 默认的服务列表过期时间是刷新间隔的倍数，注册中心长时间不可用时不再使用旧的服务列表
+	defaultMaxStaleFactor = 10
 )
 
+// ErrRefreshBackoff is returned by Refresh while it's backing off after failures
+var ErrRefreshBackoff = errors.New("rpc discovery: registry refresh is backing off")
+
+// ErrStaleServers is returned instead of the last servers once they are older than the staleness cap
+var ErrStaleServers = errors.New("rpc discovery: servers from the registry are stale")
+
 func NewRegistryDiscovery(registryAddr string, timeout time.Duration) *RegistryDiscovery {
 	if timeout <= 0 {
 		timeout = defaultUpdateTimeout
@@ -27,62 +58,210 @@ func NewRegistryDiscovery(registryAddr string, timeout time.Duration) *RegistryD
 		MultiServerDiscovery: NewMultiServerDiscovery(make([]string, 0)),
 		registry:             registryAddr,
 		timeout:              timeout,
+		backoff:              backoff.NewExponential(minRefreshBackoff, maxRefreshBackoff),
+		maxStale:             defaultMaxStaleFactor * timeout,
+		httpClient:           &http.Client{Timeout: defaultRegistryTimeout},
 	}
 }
 
+// SetRefreshBackoff replaces the backoff used after failed refreshes,
+// which doubles from 1s up to 1min by default.
+func (d *RegistryDiscovery) SetRefreshBackoff(b backoff.Backoff) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.backoff = b
+}
+
+// SetPlainList makes Refresh read only the comma-joined addresses in the
+// X-Aurerpc-Servers header instead of the JSON body, for registries that predate metadata.
+func (d *RegistryDiscovery) SetPlainList(plain bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.plainList = plain
+}
+
+// SetMaxStaleness caps how long the last servers are used while the registry can't be reached,
+// once they were fetched longer than maxStale ago, Get and GetAll fail with ErrStaleServers.
+// It defaults to 10 times the refresh timeout, maxStale <= 0 means no cap.
+func (d *RegistryDiscovery) SetMaxStaleness(maxStale time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.maxStale = maxStale
+}
+
+// Metadata returns the metadata advertised by server, nil if it has none
+func (d *RegistryDiscovery) Metadata(server string) map[string]string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.metadata[server]
+}
+
 // Update 注册中心触发的服务列表更新
 func (d *RegistryDiscovery) Update(servers []string) error {
-	d.MultiServerDiscovery.Update(servers)
+	_ = d.MultiServerDiscovery.Update(servers)
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	d.lastUpdate = time.Now()
 	return nil
 }
 
 // Refresh 从注册中心获取最新的服务列表
+// 连续失败时按指数退避，退避期间直接返回 ErrRefreshBackoff，不请求注册中心，成功后重置
 func (d *RegistryDiscovery) Refresh() error {
 	d.mu.Lock()
-	defer d.mu.Unlock()
 	// 1. 检查是否需要刷新
 	if d.lastUpdate.Add(d.timeout).After(time.Now()) {
 		// no need to refresh, still within the timeout
+		d.mu.Unlock()
 		return nil
 	}
+	if d.failures > 0 && time.Now().Before(d.nextRetry) {
+		err := fmt.Errorf("%w: %d failures, retry after %s", ErrRefreshBackoff, d.failures, d.nextRetry.Format(time.RFC3339))
+		d.mu.Unlock()
+		return err
+	}
+	// 已经有刷新在进行时，等待它完成，不重复请求注册中心
+	if refreshing := d.refreshing; refreshing != nil {
+		d.mu.Unlock()
+		<-refreshing
+		d.mu.RLock()
+		defer d.mu.RUnlock()
+		return d.refreshErr
+	}
+	refreshing := make(chan struct{})
+	d.refreshing = refreshing
+	plain := d.plainList
+	d.mu.Unlock()
 	log.Printf("[RPC registry] refresh discovery from registry %s", d.registry)
 
-	// 2. 从注册中心获取最新的服务列表
-	resp, err := http.Get(d.registry)
+	// 2. 从注册中心获取最新的服务列表，请求期间不持有锁，注册中心卡住时不会阻塞其他调用
+	resp, err := d.httpClient.Get(d.registry)
+	var items []register.ServerItem
+	if err == nil {
+		items, err = readServers(resp, plain)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defer close(refreshing)
+	d.refreshing, d.refreshErr = nil, err
 	if err != nil {
-		log.Printf("[RPC registry] refresh discovery from registry %s failed: %v", d.registry, err)
+		d.failures++
+		wait := d.backoff.Next()
+		d.nextRetry = time.Now().Add(wait)
+		log.Printf("[RPC registry] refresh discovery from registry %s failed, retry after %s: %v", d.registry, wait, err)
 		return err
 	}
+	d.failures = 0
+	d.backoff.Reset()
 
-	// 3. 从Header中获取服务器列表
-	servers := strings.Split(resp.Header.Get(register.HeaderGetAllServersList), ",")
-	d.servers = make([]string, 0, len(servers))
+	// 3. 保存服务列表和元数据
+	d.apply(items, resp)
+	d.lastUpdate = time.Now() // update last update time
+	log.Printf("[RPC registry] refresh discovery from registry %s success, servers: %v", d.registry, d.servers)
+	return nil
+}
 
-	// 4. 遍历服务器列表，去除空白字符并添加到d.servers中
-	for _, s := range servers {
-		if s = strings.TrimSpace(s); s != "" {
-			// only add non-empty server addresses
-			d.servers = append(d.servers, s)
+// apply saves the servers read from resp, d.mu must be held.
+// 元数据中的 weight 作为加权选择模式的权重
+func (d *RegistryDiscovery) apply(items []register.ServerItem, resp *http.Response) {
+	d.servers = make([]string, 0, len(items))
+	d.metadata = make(map[string]map[string]string, len(items))
+	d.weights = make(map[string]int)
+	for _, item := range items {
+		d.servers = append(d.servers, item.Addr)
+		if item.Metadata == nil {
+			continue
+		}
+		d.metadata[item.Addr] = item.Metadata
+		if weight, err := strconv.Atoi(item.Metadata["weight"]); err == nil {
+			d.weights[item.Addr] = max(weight, 1)
 		}
 	}
-	d.lastUpdate = time.Now() // update last update time
-	log.Printf("[RPC registry] refresh discovery from registry %s success, servers: %v", d.registry, d.servers)
+	if version, err := strconv.ParseUint(resp.Header.Get(register.HeaderRegistryVersion), 10, 64); err == nil {
+		d.version = version
+	}
+}
+
+// readServers reads the servers from the response of the registry and closes its body,
+// only the addresses in the header are read if plain is true.
+func readServers(resp *http.Response, plain bool) ([]register.ServerItem, error) {
+	defer func() { _ = resp.Body.Close() }()
+	// 注册中心出错时的响应中没有服务列表，不能用它覆盖上一次的服务列表
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rpc discovery: registry responded %s", resp.Status)
+	}
+	var items []register.ServerItem
+	if plain {
+		for _, s := range strings.Split(resp.Header.Get(register.HeaderGetAllServersList), ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				// only add non-empty server addresses
+				items = append(items, register.ServerItem{Addr: s})
+			}
+		}
+		return items, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&items); err != nil {
+		return nil, fmt.Errorf("rpc discovery: decode servers from registry: %w", err)
+	}
+	return items, nil
+}
+
+// refresh refreshes the servers, a failure is ignored if the last servers are known,
+// so that they keep being served while the registry is down, unless they are stale.
+func (d *RegistryDiscovery) refresh() error {
+	err := d.Refresh()
+	if err == nil || d.MultiServerDiscovery.Size() == 0 {
+		return err
+	}
+	d.mu.RLock()
+	age, maxStale := time.Since(d.lastUpdate), d.maxStale
+	d.mu.RUnlock()
+	if maxStale > 0 && age > maxStale {
+		return fmt.Errorf("%w: last updated %s ago: %w", ErrStaleServers, age.Round(time.Millisecond), err)
+	}
 	return nil
 }
 
 func (d *RegistryDiscovery) Get(mode SelectMode) (string, error) {
 	// 在获取服务器之前先刷新服务列表，确保服务列表没有过期
-	if err := d.Refresh(); err != nil {
+	if err := d.refresh(); err != nil {
 		return "", err
 	}
 	return d.MultiServerDiscovery.Get(mode)
 }
 
+func (d *RegistryDiscovery) GetExcluding(mode SelectMode, exclude []string) (string, error) {
+	if err := d.refresh(); err != nil {
+		return "", err
+	}
+	return d.MultiServerDiscovery.GetExcluding(mode, exclude)
+}
+
+func (d *RegistryDiscovery) GetByKey(key string) (string, error) {
+	if err := d.refresh(); err != nil {
+		return "", err
+	}
+	return d.MultiServerDiscovery.GetByKey(key)
+}
+
 func (d *RegistryDiscovery) GetAll() ([]string, error) {
 	// 在获取所有服务器之前先刷新服务列表，确保服务列表没有过期
-	if err := d.Refresh(); err != nil {
+	if err := d.refresh(); err != nil {
 		return nil, err
 	}
 	return d.MultiServerDiscovery.GetAll()
 }
+
+// Size returns the number of servers after refreshing from the registry,
+// the last servers are counted if the refresh fails.
+func (d *RegistryDiscovery) Size() int {
+	if err := d.Refresh(); err != nil {
+		log.Printf("[RPC registry] refresh discovery from registry %s failed, keep the last servers: %v", d.registry, err)
+	}
+	return d.MultiServerDiscovery.Size()
+}
+
+func (d *RegistryDiscovery) IsEmpty() bool {
+	return d.Size() == 0
+}
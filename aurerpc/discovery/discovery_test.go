@@ -0,0 +1,357 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"aurerpc/register"
+)
+
+func TestGetExcluding(t *testing.T) {
+	servers := []string{"tcp@127.0.0.1:9001", "tcp@127.0.0.1:9002"}
+	d := NewMultiServerDiscovery(servers)
+	for _, mode := range []SelectMode{RandomSelect, RoundRobinSelect} {
+		for range 10 {
+			addr, err := d.GetExcluding(mode, servers[:1])
+			_assert(err == nil && addr == servers[1], "expect %s, got %s %v", servers[1], addr, err)
+		}
+	}
+	_, err := d.GetExcluding(RoundRobinSelect, servers)
+	_assert(err != nil, "expect an error when all servers are excluded")
+}
+
+func TestDiscoverySize(t *testing.T) {
+	d := NewMultiServerDiscovery(nil)
+	_assert(d.IsEmpty() && d.Size() == 0, "discovery should be empty")
+	_ = d.Update([]string{"tcp@127.0.0.1:9001", "tcp@127.0.0.1:9002"})
+	_assert(!d.IsEmpty() && d.Size() == 2, "expect 2 servers, got %d", d.Size())
+	_ = d.Update([]string{"tcp@127.0.0.1:9001"})
+	_assert(d.Size() == 1, "expect 1 server, got %d", d.Size())
+}
+
+func TestRegistryDiscoverySize(t *testing.T) {
+	ts := httptest.NewServer(register.New(time.Minute))
+	defer ts.Close()
+	d := NewRegistryDiscovery(ts.URL, 0)
+	_assert(d.IsEmpty(), "discovery should be empty before any heartbeat")
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL, nil)
+	req.Header.Set(register.HeaderPostAppend, "tcp@127.0.0.1:9001")
+	resp, err := http.DefaultClient.Do(req)
+	_assert(err == nil, "heartbeat failed: %v", err)
+	_ = resp.Body.Close()
+
+	// 服务列表在 timeout 内不会重新拉取，清空 lastUpdate 强制刷新
+	d.lastUpdate = time.Time{}
+	_assert(d.Size() == 1, "size should refresh from the registry, got %d", d.Size())
+}
+
+func TestRegistryDiscoveryMetadata(t *testing.T) {
+	ts := httptest.NewServer(register.New(time.Minute))
+	defer ts.Close()
+	heartbeat := func(addr string, meta map[string]string) {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL, nil)
+		req.Header.Set(register.HeaderPostAppend, addr)
+		for k, v := range meta {
+			req.Header.Set(register.HeaderMetadataPrefix+k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		_assert(err == nil, "heartbeat failed: %v", err)
+		_ = resp.Body.Close()
+	}
+	heartbeat("a", map[string]string{"weight": "3", "zone": "us-east"})
+	heartbeat("b", nil)
+
+	d := NewRegistryDiscovery(ts.URL, time.Minute)
+	_assert(d.Refresh() == nil, "refresh failed")
+	_assert(d.Metadata("a")["zone"] == "us-east" && d.Metadata("b") == nil, "unexpected metadata %v %v", d.Metadata("a"), d.Metadata("b"))
+	// 元数据中的 weight 用于加权选择
+	counts := make(map[string]int)
+	for range 400 {
+		addr, _ := d.Get(WeightedRoundRobinSelect)
+		counts[addr]++
+	}
+	_assert(counts["a"] == 300 && counts["b"] == 100, "selections should follow the advertised weights: %v", counts)
+
+	// 兼容模式只读取 header 中的地址列表
+	plain := NewRegistryDiscovery(ts.URL, time.Minute)
+	plain.SetPlainList(true)
+	all, err := plain.GetAll()
+	_assert(err == nil && slices.Equal(all, []string{"a", "b"}) && plain.Metadata("a") == nil, "unexpected plain list %v %v", all, err)
+}
+
+func TestRegistryDiscoveryWatch(t *testing.T) {
+	r := register.New(time.Minute)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	d := NewRegistryDiscovery(ts.URL, time.Hour)
+	_assert(d.Refresh() == nil && d.MultiServerDiscovery.Size() == 0, "expect no server")
+	stop := d.Watch(10 * time.Second)
+	defer stop()
+
+	// 不必等待一小时的刷新间隔，新的服务几乎立即被发现
+	req, _ := http.NewRequest(http.MethodPost, ts.URL, nil)
+	req.Header.Set(register.HeaderPostAppend, "tcp@127.0.0.1:9001")
+	resp, err := http.DefaultClient.Do(req)
+	_assert(err == nil, "heartbeat failed: %v", err)
+	_ = resp.Body.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for d.MultiServerDiscovery.Size() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	all, _ := d.GetAll()
+	_assert(slices.Equal(all, []string{"tcp@127.0.0.1:9001"}), "expect the new server to be watched, got %v", all)
+}
+
+func TestRegistryDiscoveryWatchHungRegistry(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	// 注册中心接受连接但不响应时，一次长轮询在 wait 加上请求超时之后失败
+	d := NewRegistryDiscovery(ts.URL, time.Hour)
+	d.httpClient.Timeout = 50 * time.Millisecond
+	done := make(chan error, 1)
+	go func() {
+		_, err := d.poll(context.Background(), 20*time.Millisecond)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		_assert(errors.Is(err, context.DeadlineExceeded), "expect the poll to time out, got %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("the poll should not block on a hung registry")
+	}
+}
+
+func TestRegistryDiscoveryOutage(t *testing.T) {
+	ts := httptest.NewServer(register.New(time.Minute))
+	req, _ := http.NewRequest(http.MethodPost, ts.URL, nil)
+	req.Header.Set(register.HeaderPostAppend, "tcp@127.0.0.1:9001")
+	resp, err := http.DefaultClient.Do(req)
+	_assert(err == nil, "heartbeat failed: %v", err)
+	_ = resp.Body.Close()
+
+	d := NewRegistryDiscovery(ts.URL, 10*time.Millisecond)
+	d.SetMaxStaleness(300 * time.Millisecond)
+	_assert(d.Refresh() == nil, "refresh failed")
+	ts.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	// 注册中心停止后继续使用缓存的服务列表
+	for range 5 {
+		addr, err := d.Get(RoundRobinSelect)
+		_assert(err == nil && addr == "tcp@127.0.0.1:9001", "expect the cached server, got %s %v", addr, err)
+	}
+	// 服务列表过期后返回错误
+	time.Sleep(300 * time.Millisecond)
+	_, err = d.Get(RoundRobinSelect)
+	_assert(errors.Is(err, ErrStaleServers), "expect ErrStaleServers after the staleness cap, got %v", err)
+}
+
+func TestRegistryDiscoveryDefaultStaleness(t *testing.T) {
+	ts := httptest.NewServer(register.New(time.Minute))
+	req, _ := http.NewRequest(http.MethodPost, ts.URL, nil)
+	req.Header.Set(register.HeaderPostAppend, "tcp@127.0.0.1:9001")
+	resp, err := http.DefaultClient.Do(req)
+	_assert(err == nil, "heartbeat failed: %v", err)
+	_ = resp.Body.Close()
+
+	// 没有调用 SetMaxStaleness 时，服务列表在刷新间隔的 10 倍之后过期
+	d := NewRegistryDiscovery(ts.URL, 20*time.Millisecond)
+	_assert(d.Refresh() == nil, "refresh failed")
+	ts.Close()
+	addr, err := d.Get(RoundRobinSelect)
+	_assert(err == nil && addr == "tcp@127.0.0.1:9001", "expect the cached server, got %s %v", addr, err)
+	time.Sleep(250 * time.Millisecond)
+	_, err = d.Get(RoundRobinSelect)
+	_assert(errors.Is(err, ErrStaleServers), "expect ErrStaleServers by default, got %v", err)
+}
+
+func TestRegistryDiscoveryHungRegistry(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	d := NewRegistryDiscovery(ts.URL, 10*time.Millisecond)
+	d.httpClient.Timeout = 200 * time.Millisecond
+	d.SetMaxStaleness(time.Minute) // the default cap of 100ms is shorter than the hung refresh
+	_ = d.Update([]string{"tcp@127.0.0.1:9001"})
+	time.Sleep(20 * time.Millisecond)
+
+	// 刷新期间不持有锁，其他操作不会被阻塞
+	done := make(chan error, 1)
+	go func() { done <- d.Refresh() }()
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	_ = d.MultiServerDiscovery.Update([]string{"tcp@127.0.0.1:9001"})
+	_assert(time.Since(start) < 50*time.Millisecond, "update should not wait for the refresh, took %s", time.Since(start))
+
+	// 注册中心卡住时，刷新在超时后失败，继续使用缓存的服务列表
+	select {
+	case err := <-done:
+		_assert(err != nil, "refresh should fail on the client timeout")
+	case <-time.After(2 * time.Second):
+		t.Fatal("refresh should not block longer than the client timeout")
+	}
+	addr, err := d.Get(RoundRobinSelect)
+	_assert(err == nil && addr == "tcp@127.0.0.1:9001", "expect the cached server, got %s %v", addr, err)
+}
+
+func TestFailoverSelect(t *testing.T) {
+	servers := []string{"tcp@127.0.0.1:9001", "tcp@127.0.0.1:9002", "tcp@127.0.0.1:9003"}
+	d := NewMultiServerDiscovery(servers)
+	for range 5 {
+		addr, err := d.Get(FailoverSelect)
+		_assert(err == nil && addr == servers[0], "expect the primary %s, got %s %v", servers[0], addr, err)
+	}
+
+	// 主服务器被标记后切换到下一个，并且之后一直使用新的主服务器
+	d.MarkBad(servers[0], 50*time.Millisecond)
+	for range 5 {
+		addr, _ := d.Get(FailoverSelect)
+		_assert(addr == servers[1], "expect failover to %s, got %s", servers[1], addr)
+	}
+	time.Sleep(60 * time.Millisecond)
+	addr, _ := d.Get(FailoverSelect)
+	_assert(addr == servers[1], "the primary should stay at %s after the cooldown, got %s", servers[1], addr)
+
+	// 其他模式也会跳过被标记的服务器
+	d.MarkBad(servers[1], time.Minute)
+	for range 10 {
+		addr, _ := d.Get(RandomSelect)
+		_assert(addr != servers[1], "bad server %s should be skipped", addr)
+	}
+	// 所有服务器都被标记时，仍然可以选出服务器
+	d.MarkBad(servers[0], time.Minute)
+	d.MarkBad(servers[2], time.Minute)
+	_, err := d.Get(RoundRobinSelect)
+	_assert(err == nil, "expect a server when all are marked bad: %v", err)
+}
+
+func TestWeightedRoundRobinSelect(t *testing.T) {
+	d := NewWeightedDiscovery(map[string]int{"a": 5, "b": 1, "c": 1})
+	var got []string
+	for range 7 {
+		addr, err := d.Get(WeightedRoundRobinSelect)
+		_assert(err == nil, "get failed: %v", err)
+		got = append(got, addr)
+	}
+	// 平滑加权轮询，权重大的服务器不会被连续选中太多次
+	_assert(slices.Equal(got, []string{"a", "a", "b", "a", "c", "a", "a"}), "unexpected selections %v", got)
+
+	counts := make(map[string]int)
+	for range 700 {
+		addr, _ := d.Get(WeightedRoundRobinSelect)
+		counts[addr]++
+	}
+	_assert(counts["a"] == 500 && counts["b"] == 100 && counts["c"] == 100, "selections should be proportional to weights: %v", counts)
+
+	all, _ := d.GetAll()
+	_assert(slices.Equal(all, []string{"a", "b", "c"}), "GetAll should return every address once, got %v", all)
+	for range 3 {
+		addr, _ := d.Get(RoundRobinSelect)
+		_assert(slices.Contains(all, addr), "round robin should still work, got %s", addr)
+	}
+}
+
+func TestWeightedRandomSelect(t *testing.T) {
+	weights := map[string]int{"a": 6, "b": 3, "c": 1}
+	d := NewWeightedDiscovery(weights)
+	const n = 10000
+	counts := make(map[string]int)
+	for range n {
+		addr, err := d.Get(WeightedRandomSelect)
+		_assert(err == nil, "get failed: %v", err)
+		counts[addr]++
+	}
+	// 每台服务器被选中的比例接近权重占比，允许 2% 的偏差
+	for server, weight := range weights {
+		want := float64(weight) / 10
+		got := float64(counts[server]) / n
+		_assert(math.Abs(got-want) < 0.02, "%s should be selected %.2f of the time, got %.4f: %v", server, want, got, counts)
+	}
+
+	// 没有权重的服务器权重为 1
+	d = NewMultiServerDiscovery([]string{"x", "y"})
+	counts = make(map[string]int)
+	for range n {
+		addr, _ := d.Get(WeightedRandomSelect)
+		counts[addr]++
+	}
+	_assert(math.Abs(float64(counts["x"])/n-0.5) < 0.02, "servers without weights should be equally likely: %v", counts)
+}
+
+func TestGetByKey(t *testing.T) {
+	servers := []string{"tcp@127.0.0.1:9001", "tcp@127.0.0.1:9002", "tcp@127.0.0.1:9003"}
+	d := NewMultiServerDiscovery(servers)
+	_, err := d.Get(ConsistentHashSelect)
+	_assert(err != nil, "Get should not support ConsistentHashSelect")
+
+	before := make(map[string]string)
+	counts := make(map[string]int)
+	for i := range 300 {
+		key := fmt.Sprintf("key-%d", i)
+		addr, err := d.GetByKey(key)
+		_assert(err == nil, "get by key failed: %v", err)
+		again, _ := d.GetByKey(key)
+		_assert(addr == again, "key %s should map to the same server, got %s and %s", key, addr, again)
+		before[key] = addr
+		counts[addr]++
+	}
+	for _, server := range servers {
+		_assert(counts[server] > 50, "keys should be distributed evenly: %v", counts)
+	}
+
+	// 移除一台服务器后，只有原来映射到它的 key 会重新分配
+	_ = d.Update(servers[:2])
+	for key, addr := range before {
+		now, _ := d.GetByKey(key)
+		if addr == servers[2] {
+			_assert(now != servers[2], "key %s should be moved off the removed server", key)
+		} else {
+			_assert(now == addr, "key %s should stay on %s, got %s", key, addr, now)
+		}
+	}
+}
+
+func TestRegistryDiscoveryRefreshBackoff(t *testing.T) {
+	var attempts atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	d := NewRegistryDiscovery(ts.URL, 10*time.Millisecond)
+	_ = d.Update([]string{"tcp@127.0.0.1:9001"})
+	time.Sleep(20 * time.Millisecond)
+
+	// 注册中心不可用时，继续使用上一次的服务列表，并且不会每次 Get 都请求注册中心
+	for range 20 {
+		addr, err := d.Get(RoundRobinSelect)
+		_assert(err == nil && addr == "tcp@127.0.0.1:9001", "expect the last known server, got %s %v", addr, err)
+	}
+	_assert(attempts.Load() == 1, "expect 1 refresh attempt during the backoff, got %d", attempts.Load())
+	err := d.Refresh()
+	_assert(errors.Is(err, ErrRefreshBackoff), "expect ErrRefreshBackoff, got %v", err)
+
+	// 退避结束后再次失败，退避时间翻倍
+	d.nextRetry = time.Time{}
+	_, _ = d.Get(RoundRobinSelect)
+	_assert(attempts.Load() == 2, "expect a refresh attempt after the backoff, got %d", attempts.Load())
+	_assert(time.Until(d.nextRetry) > 1500*time.Millisecond, "backoff should double after the second failure")
+}
@@ -0,0 +1,89 @@
+package discovery
+
+import (
+	"aurerpc/backoff"
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Watch keeps a long-poll request to the registry, which returns once the servers change
+// or wait has passed, so that new servers are picked up almost instantly instead of
+// after the refresh timeout. The returned func stops watching.
+// 注册中心不支持长轮询时请求会立即返回，此时每次请求之间至少间隔 wait
+func (d *RegistryDiscovery) Watch(wait time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go d.watch(ctx, wait)
+	return cancel
+}
+
+func (d *RegistryDiscovery) watch(ctx context.Context, wait time.Duration) {
+	waits := backoff.NewExponential(minRefreshBackoff, maxRefreshBackoff)
+	for ctx.Err() == nil {
+		start := time.Now()
+		changed, err := d.poll(ctx, wait)
+		var pause time.Duration
+		if err != nil {
+			pause = waits.Next()
+			log.Printf("[RPC registry] watch registry %s failed, retry after %s: %v", d.registry, pause, err)
+		} else {
+			waits.Reset()
+			// 服务列表没有变化却提前返回，说明注册中心不支持长轮询，等到 wait 再请求
+			if elapsed := time.Since(start); !changed && elapsed < wait {
+				pause = wait - elapsed
+			}
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(pause):
+		}
+	}
+}
+
+// poll sends a long-poll request with the current version and applies the servers in the response,
+// changed reports whether the version has changed.
+func (d *RegistryDiscovery) poll(ctx context.Context, wait time.Duration) (changed bool, err error) {
+	d.mu.RLock()
+	since := d.version
+	d.mu.RUnlock()
+
+	u, err := url.Parse(d.registry)
+	if err != nil {
+		return false, err
+	}
+	query := u.Query()
+	query.Set("wait", wait.String())
+	query.Set("since", strconv.FormatUint(since, 10))
+	u.RawQuery = query.Encode()
+	// 注册中心最多挂起请求 wait，再加上普通刷新请求的超时时间，半开的连接不会让 Watch 一直阻塞
+	ctx, cancel := context.WithTimeout(ctx, wait+d.httpClient.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+
+	d.mu.RLock()
+	plain := d.plainList
+	d.mu.RUnlock()
+	items, err := readServers(resp, plain)
+	if err != nil {
+		return false, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.apply(items, resp)
+	d.lastUpdate = time.Now()
+	if d.version == since {
+		return false, nil
+	}
+	log.Printf("[RPC registry] registry %s changed to version %d, servers: %v", d.registry, d.version, d.servers)
+	return true, nil
+}
@@ -0,0 +1,73 @@
+package discovery
+
+import (
+	"hash/crc32"
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// HashFunc maps bytes to a position on the hash ring
+type HashFunc func(data []byte) uint32
+
+// CRC32Hash is the default HashFunc of HashRing
+func CRC32Hash(data []byte) uint32 {
+	return crc32.ChecksumIEEE(data)
+}
+
+// FNVHash hashes data with 32-bit FNV-1a
+func FNVHash(data []byte) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write(data)
+	return h.Sum32()
+}
+
+// HashRing 一致性哈希环，用于将同一个 key 稳定地映射到同一台服务器
+// 每台服务器对应 replicas 个虚拟节点，使 key 在服务器之间分布更均匀
+// 哈希函数可以替换，以便与已有的分片方案保持一致
+type HashRing struct {
+	hash     HashFunc
+	replicas int
+	keys     []int // sorted
+	hashMap  map[int]string
+}
+
+// NewHashRing creates a HashRing with replicas virtual nodes per server,
+// fn defaults to CRC32Hash if nil.
+func NewHashRing(replicas int, fn HashFunc) *HashRing {
+	if replicas <= 0 {
+		replicas = 1
+	}
+	if fn == nil {
+		fn = CRC32Hash
+	}
+	return &HashRing{
+		hash:     fn,
+		replicas: replicas,
+		hashMap:  make(map[int]string),
+	}
+}
+
+// Add adds servers to the ring
+func (r *HashRing) Add(servers ...string) {
+	for _, server := range servers {
+		for i := 0; i < r.replicas; i++ {
+			// 虚拟节点的名称为 编号 + 服务器地址
+			hash := int(r.hash([]byte(strconv.Itoa(i) + server)))
+			r.keys = append(r.keys, hash)
+			r.hashMap[hash] = server
+		}
+	}
+	sort.Ints(r.keys)
+}
+
+// Get returns the server that key is mapped to, or "" if the ring is empty
+func (r *HashRing) Get(key string) string {
+	if len(r.keys) == 0 {
+		return ""
+	}
+	hash := int(r.hash([]byte(key)))
+	// 顺时针找到第一个不小于 hash 的虚拟节点
+	idx := sort.SearchInts(r.keys, hash)
+	return r.hashMap[r.keys[idx%len(r.keys)]]
+}
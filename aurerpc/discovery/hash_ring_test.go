@@ -0,0 +1,31 @@
+package discovery
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHashRing(t *testing.T) {
+	servers := []string{"tcp@127.0.0.1:9001", "tcp@127.0.0.1:9002", "tcp@127.0.0.1:9003"}
+	for name, fn := range map[string]HashFunc{"crc32": CRC32Hash, "fnv": FNVHash} {
+		t.Run(name, func(t *testing.T) {
+			r1, r2 := NewHashRing(50, fn), NewHashRing(50, fn)
+			r1.Add(servers...)
+			r2.Add(servers...)
+			for i := range 100 {
+				key := fmt.Sprintf("key-%d", i)
+				_assert(r1.Get(key) != "", "key %s should be mapped to a server", key)
+				_assert(r1.Get(key) == r2.Get(key), "rings with the same hash should map %s identically", key)
+			}
+		})
+	}
+
+	t.Run("custom hash", func(t *testing.T) {
+		// 所有 key 都映射到 0，应该选中第一个虚拟节点
+		r := NewHashRing(1, func(data []byte) uint32 { return 0 })
+		r.Add("tcp@127.0.0.1:9001")
+		_assert(r.Get("any") == "tcp@127.0.0.1:9001", "custom hash func should be used")
+	})
+
+	_assert(NewHashRing(1, nil).Get("key") == "", "empty ring should return no server")
+}
@@ -1,3 +1,10 @@
 module aurerpc
 
 go 1.23.2
+
+require (
+	github.com/golang/snappy v1.0.0
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+)
+
+require github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
@@ -1,9 +1,16 @@
 package register
 
 import (
+	"aurerpc/backoff"
+	"context"
+	"encoding/json"
+	"fmt"
 	"log"
+	"maps"
 	"net/http"
+	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -11,87 +18,272 @@ import (
 
 const (
 	defaultPath             = "/_aurerpc_/registry"
-	defaultTimeout          = 5 * time.Minute // 超时时间
+	defaultTimeout          = 5 * time.Minute  // 超时时间
+	defaultRequestTimeout   = 10 * time.Second // 一次 SyncWith、心跳或注销请求的超时时间
 	HeaderGetAllServersList = "X-Aurerpc-Servers"
 	HeaderPostAppend        = "X-Aurerpc-Server"
+	// HeaderMetadataPrefix 心跳请求中以此为前缀的 header 作为服务的元数据，例如 X-Aurerpc-Meta-Weight: 5
+	// 元数据的 key 为去掉前缀后的小写名字，例如 weight
+	HeaderMetadataPrefix = "X-Aurerpc-Meta-"
+	// 持久化的防抖时间，这段时间内的多次变化只写一次文件
+	defaultPersistDelay = time.Second
 )
 
 type Registry struct {
 	timeout  time.Duration
 	mu       sync.Mutex
 	services map[string]*ServerItem
+	// 持久化服务列表的文件，为空时不持久化，见 New
+	path         string
+	persistDelay time.Duration
+	saveTimer    *time.Timer // pending write of the file, protected by mu
+	// 服务列表的版本号，以及服务列表变化时关闭的信道，用于长轮询，见 watch.go
+	version uint64
+	changed chan struct{}
+	// SyncWith 请求对方注册中心使用的 HTTP 客户端，带有超时，对方卡住时同步不会一直阻塞
+	syncClient *http.Client
 }
 
 type ServerItem struct {
-	Addr  string
-	Start time.Time
+	Addr     string
+	Start    time.Time
+	Metadata map[string]string `json:",omitempty"` // advertised by the server in its heartbeats, e.g. weight, zone
 }
 
-func New(timeout time.Duration) *Registry {
+// New returns a registry whose servers time out without heartbeats after timeout.
+// If persistPath is given, the servers are saved to the file as JSON when they change,
+// and loaded from it on creation, so that a restarted registry still knows them.
+func New(timeout time.Duration, persistPath ...string) *Registry {
 	if timeout <= 0 {
 		timeout = defaultTimeout
 	}
-	return &Registry{
-		timeout:  timeout,
-		services: make(map[string]*ServerItem),
+	r := &Registry{
+		timeout:      timeout,
+		services:     make(map[string]*ServerItem),
+		persistDelay: defaultPersistDelay,
+		syncClient:   &http.Client{Timeout: defaultRequestTimeout},
 	}
+	if len(persistPath) > 0 && persistPath[0] != "" {
+		// 先加载再设置 path，加载的内容与文件相同，不需要写回
+		if err := r.load(persistPath[0]); err != nil {
+			log.Println("[RPC registry] load servers from", persistPath[0], "failed:", err)
+		}
+		r.path = persistPath[0]
+	}
+	return r
+}
+
+// load reads the servers saved in path, the ones already timed out are dropped
+func (r *Registry) load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var items []ServerItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	r.merge(items)
+	return nil
+}
+
+// scheduleSave writes the servers to r.path after persistDelay, mu must be held.
+// 防抖：已有待写入时不再重复安排，写入时保存的是最新的服务列表
+func (r *Registry) scheduleSave() {
+	if r.path == "" || r.saveTimer != nil {
+		return
+	}
+	r.saveTimer = time.AfterFunc(r.persistDelay, func() {
+		if err := r.save(); err != nil {
+			log.Println("[RPC registry] save servers to", r.path, "failed:", err)
+		}
+	})
+}
+
+// save writes the servers to r.path, through a temporary file renamed over it
+// so that a crash in the middle doesn't leave a truncated file
+func (r *Registry) save() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.saveTimer = nil
+
+	items := make([]ServerItem, 0, len(r.services))
+	for _, item := range r.services {
+		items = append(items, *item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Addr < items[j].Addr })
+	data, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
 }
 
 var DefaultRegistry = New(defaultTimeout)
 
 // putServer add server address to registry center, if it exists, update its start time
+// and metadata
 //
-// 将服务器地址添加到注册中心，如果已存在则更新其开始时间
-func (r *Registry) putServer(addr string) {
+// 将服务器地址添加到注册中心，如果已存在则更新其开始时间和元数据
+func (r *Registry) putServer(addr string, metadata ...map[string]string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	var meta map[string]string
+	if len(metadata) > 0 {
+		meta = metadata[0]
+	}
 	if item, ok := r.services[addr]; ok {
 		item.Start = time.Now() // 更新服务的开始时间
+		if !maps.Equal(item.Metadata, meta) {
+			item.Metadata = meta
+			r.bumpVersion()
+		}
 	} else {
 		r.services[addr] = &ServerItem{
-			Addr:  addr,
-			Start: time.Now(),
+			Addr:     addr,
+			Start:    time.Now(),
+			Metadata: meta,
 		}
+		r.bumpVersion()
+	}
+	r.scheduleSave()
+}
+
+// removeServer removes server address from registry center
+func (r *Registry) removeServer(addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.services[addr]; ok {
+		delete(r.services, addr)
+		r.bumpVersion()
+		r.scheduleSave()
 	}
 }
 
 // listAliveServers list all alive servers and remove those that have timed out
 func (r *Registry) listAliveServers() []string {
+	items := r.listAliveItems()
+	aliveServers := make([]string, 0, len(items))
+	for _, item := range items {
+		aliveServers = append(aliveServers, item.Addr)
+	}
+	return aliveServers
+}
+
+// listAliveItems returns a copy of all alive servers sorted by address,
+// and removes those that have timed out
+func (r *Registry) listAliveItems() []ServerItem {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	var aliveServers []string
+	var items []ServerItem
 	for addr, item := range r.services {
 		if time.Since(item.Start) < r.timeout {
-			aliveServers = append(aliveServers, addr)
+			items = append(items, *item)
 		} else {
 			delete(r.services, addr)
+			r.bumpVersion()
+			r.scheduleSave()
 		}
 	}
-	sort.Strings(aliveServers)
-	return aliveServers
+	sort.Slice(items, func(i, j int) bool { return items[i].Addr < items[j].Addr })
+	return items
+}
+
+// merge 合并其他注册中心的服务列表，同一地址以最近一次心跳（Start 更新）为准
+func (r *Registry) merge(items []ServerItem) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	changed := false
+	for _, item := range items {
+		if time.Since(item.Start) >= r.timeout {
+			continue
+		}
+		if local, ok := r.services[item.Addr]; ok {
+			if item.Start.After(local.Start) {
+				if !maps.Equal(local.Metadata, item.Metadata) {
+					r.bumpVersion()
+				}
+				local.Start, local.Metadata = item.Start, item.Metadata
+				changed = true
+			}
+		} else {
+			r.services[item.Addr] = &ServerItem{Addr: item.Addr, Start: item.Start, Metadata: item.Metadata}
+			r.bumpVersion()
+			changed = true
+		}
+	}
+	// 没有变化时不写文件，每次 SyncWith 同步到相同的列表不会重写文件
+	if changed {
+		r.scheduleSave()
+	}
 }
 
-// ServeHTTP runs at /_aurerpc_/registry, handles GET and POST requests
+// ServeHTTP runs at /_aurerpc_/registry, handles GET, POST and DELETE requests
 func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case http.MethodGet:
-		aliveServers := r.listAliveServers()
+		// Header 中只有地址列表，兼容旧的服务发现；Body 中的 JSON 还包含 Start 和元数据，
+		// 供其他注册中心同步和服务发现使用
+		if since, wait, ok := parseWatch(req); ok {
+			r.waitChange(req.Context(), since, wait)
+		}
+		items := r.listAliveItems()
+		w.Header().Set(HeaderRegistryVersion, strconv.FormatUint(r.currentVersion(), 10))
+		aliveServers := make([]string, 0, len(items))
+		for _, item := range items {
+			aliveServers = append(aliveServers, item.Addr)
+		}
 		w.Header().Set(HeaderGetAllServersList, strings.Join(aliveServers, ","))
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(items)
 	case http.MethodPost:
 		addr := req.Header.Get(HeaderPostAppend)
 		if addr == "" {
 			http.Error(w, "Server address is required", http.StatusBadRequest)
 			return
 		}
-		r.putServer(addr)
+		r.putServer(addr, metadataFromHeader(req.Header))
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		// 服务端下线时主动注销，不必等待心跳超时
+		addr := req.Header.Get(HeaderPostAppend)
+		if addr == "" {
+			http.Error(w, "Server address is required", http.StatusBadRequest)
+			return
+		}
+		r.removeServer(addr)
 		w.WriteHeader(http.StatusOK)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
+// metadataFromHeader collects the headers prefixed by HeaderMetadataPrefix, nil if there is none
+func metadataFromHeader(header http.Header) map[string]string {
+	var meta map[string]string
+	for key, values := range header {
+		name, ok := strings.CutPrefix(key, HeaderMetadataPrefix)
+		if !ok || name == "" || len(values) == 0 {
+			continue
+		}
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		meta[strings.ToLower(name)] = values[0]
+	}
+	return meta
+}
+
 // HandleHTTP binds the registry to a specific path
 func (r *Registry) HandleHTTP(registryPath string) {
 	http.Handle(registryPath, r) // 将 registryPath 绑定到实例 r 上
@@ -102,43 +294,191 @@ func HandleHTTP() {
 	DefaultRegistry.HandleHTTP(defaultPath)
 }
 
-func sendHeartbeat(registry, addr string) error {
+// syncFrom fetches the alive servers of the peer registry and merges them
+func (r *Registry) syncFrom(ctx context.Context, peer string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.syncClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var items []ServerItem
+	if err := json.NewDecoder(resp.Body).Decode(&items); err != nil {
+		return err
+	}
+	r.merge(items)
+	return nil
+}
+
+// SyncWith 定期从另一个注册中心拉取存活的服务列表并合并到本地，用于多个注册中心之间的简单复制
+// 两个注册中心互相 SyncWith，最终都会得到两者服务列表的并集
+// peer 是对方注册中心的完整地址，例如 http://localhost:9999/_aurerpc_/registry
+// The first sync is done before returning, the returned func stops syncing.
+func (r *Registry) SyncWith(peer string, interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		interval = r.timeout / 2
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := r.syncFrom(ctx, peer); err != nil {
+		log.Println("[RPC registry] sync with", peer, "failed:", err)
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		// 对方暂时不可用时继续重试，直到 stop 被调用
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := r.syncFrom(ctx, peer); err != nil && ctx.Err() == nil {
+				log.Println("[RPC registry] sync with", peer, "failed:", err)
+			}
+		}
+	}()
+	return cancel
+}
+
+// registryClient sends heartbeats and deregistrations, every request is also bounded by
+// the timeout of its context, see heartbeatTimeout.
+var registryClient = &http.Client{Timeout: defaultRequestTimeout}
+
+// heartbeatTimeout bounds a heartbeat request, it's shorter than interval so that
+// a registry which never responds fails the heartbeat instead of blocking it
+func heartbeatTimeout(interval time.Duration) time.Duration {
+	return min(defaultRequestTimeout, interval/2)
+}
+
+func sendHeartbeat(ctx context.Context, registry, addr string, metadata map[string]string) error {
 	log.Println("Sending heartbeat to registry:", registry, "from server:", addr)
-	httpClient := &http.Client{}
-	req, err := http.NewRequest(http.MethodPost, registry, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, registry, nil)
 	if err != nil {
 		log.Println("Failed to create heartbeat request:", err)
 		return err
 	}
 	req.Header.Set(HeaderPostAppend, addr)
-	if _, err := httpClient.Do(req); err != nil {
+	for key, value := range metadata {
+		req.Header.Set(HeaderMetadataPrefix+key, value)
+	}
+	resp, err := registryClient.Do(req)
+	if err != nil {
+		log.Println("Failed to send heartbeat:", err)
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("rpc registry: heartbeat of %s responded %s", addr, resp.Status)
 		log.Println("Failed to send heartbeat:", err)
 		return err
 	}
 	return nil
 }
 
-func Heartbeat(registry, addr string, interval time.Duration) {
+// Deregister removes addr from the registry, e.g. on a graceful shutdown,
+// so that clients stop selecting it without waiting for the heartbeat to time out.
+// 之后的心跳会再次注册 addr，因此应当先调用 Heartbeat 返回的 stop 停止心跳
+func Deregister(registry, addr string) error {
+	log.Println("Deregistering from registry:", registry, "server:", addr)
+	req, err := http.NewRequest(http.MethodDelete, registry, nil)
+	if err != nil {
+		log.Println("Failed to create deregister request:", err)
+		return err
+	}
+	req.Header.Set(HeaderPostAppend, addr)
+	resp, err := registryClient.Do(req)
+	if err != nil {
+		log.Println("Failed to deregister:", err)
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("rpc registry: deregister %s responded %s", addr, resp.Status)
+	}
+	return nil
+}
+
+// DefaultMaxHeartbeatFailures is the number of consecutive failed heartbeats after which Heartbeat stops
+const DefaultMaxHeartbeatFailures = 5
+
+// Heartbeat sends a heartbeat to the registry now and then every interval,
+// see HeartbeatWithRetry for how failures are handled. The returned func stops the heartbeats.
+func Heartbeat(registry, addr string, interval time.Duration) (stop func()) {
+	return HeartbeatWithRetry(registry, addr, interval, DefaultMaxHeartbeatFailures)
+}
+
+// HeartbeatWithRetry is like Heartbeat, a failed heartbeat is retried sooner with backoff,
+// starting at a quarter of interval up to interval, and the heartbeats go on after a success.
+// 连续失败 maxFailures 次后停止发送心跳，maxFailures <= 0 表示一直重试
+// 第一次心跳同步发送，失败时直接返回，不启动心跳协程
+func HeartbeatWithRetry(registry, addr string, interval time.Duration, maxFailures int) (stop func()) {
+	return heartbeat(registry, addr, interval, maxFailures, nil)
+}
+
+// HeartbeatWithMetadata is like Heartbeat, the server advertises metadata in every heartbeat,
+// e.g. {"weight": "5", "zone": "us-east"}, the "weight" is used by RegistryDiscovery
+// for the weighted select modes.
+func HeartbeatWithMetadata(registry, addr string, interval time.Duration, metadata map[string]string) (stop func()) {
+	return heartbeat(registry, addr, interval, DefaultMaxHeartbeatFailures, metadata)
+}
+
+// heartbeat returns a func which stops the heartbeats and waits for the goroutine to exit,
+// so that no heartbeat registers addr again after a following Deregister.
+func heartbeat(registry, addr string, interval time.Duration, maxFailures int, metadata map[string]string) (stop func()) {
 	if interval <= 0 {
 		interval = defaultTimeout - 1*time.Minute
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	send := func() error {
+		ctx, cancel := context.WithTimeout(ctx, heartbeatTimeout(interval))
+		defer cancel()
+		return sendHeartbeat(ctx, registry, addr, metadata)
+	}
 
-	err := sendHeartbeat(registry, addr) // initial heartbeat
-	if err != nil {
+	if err := send(); err != nil { // initial heartbeat
 		log.Println("Initial heartbeat failed:", err)
-		return
+		cancel()
+		return func() {}
 	}
+	exited := make(chan struct{})
 	go func() {
-		ticker := time.NewTicker(interval)
-		defer ticker.Stop()
-		// should not use for { select { case <-ticker.C: } } if not other channel
-		// to exit this goroutine, otherwise it will block forever
-		for range ticker.C {
-			if err := sendHeartbeat(registry, addr); err != nil {
-				log.Println("Heartbeat failed:", err)
-				break
+		defer close(exited)
+		// 注册中心短暂不可用时重试，不能因为一次失败就永远停止心跳，导致健康的服务被注册中心移除
+		waits := backoff.NewExponential(interval/4, interval)
+		failures := 0
+		wait := interval
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+			if err := send(); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				failures++
+				if maxFailures > 0 && failures >= maxFailures {
+					log.Printf("Heartbeat failed %d times in a row, stop sending heartbeats for server %s: %v", failures, addr, err)
+					return
+				}
+				wait = waits.Next()
+				log.Printf("Heartbeat failed, retry after %s: %v", wait, err)
+				continue
 			}
+			failures, wait = 0, interval
+			waits.Reset()
 		}
 	}()
 	log.Println("Heartbeat goroutine started for server:", addr)
+	return func() {
+		cancel()
+		<-exited
+	}
 }
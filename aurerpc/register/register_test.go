@@ -0,0 +1,314 @@
+package register
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRegistrySyncWith(t *testing.T) {
+	r1, r2 := New(time.Minute), New(time.Minute)
+	s1, s2 := httptest.NewServer(r1), httptest.NewServer(r2)
+	defer s1.Close()
+	defer s2.Close()
+
+	r1.putServer("tcp@127.0.0.1:9001")
+	r1.putServer("tcp@127.0.0.1:9003")
+	r2.putServer("tcp@127.0.0.1:9002")
+	r2.putServer("tcp@127.0.0.1:9003") // 后发送心跳，Start 更新
+
+	defer r1.SyncWith(s2.URL, time.Hour)()
+	defer r2.SyncWith(s1.URL, time.Hour)()
+
+	want := []string{"tcp@127.0.0.1:9001", "tcp@127.0.0.1:9002", "tcp@127.0.0.1:9003"}
+	if got := r1.listAliveServers(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("registry 1 should have the union of servers, got %v", got)
+	}
+	if got := r2.listAliveServers(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("registry 2 should have the union of servers, got %v", got)
+	}
+	// 冲突时以最近一次心跳为准
+	if !r1.services["tcp@127.0.0.1:9003"].Start.Equal(r2.services["tcp@127.0.0.1:9003"].Start) {
+		t.Fatal("the latest heartbeat should win")
+	}
+}
+
+func TestRegistrySyncWithStop(t *testing.T) {
+	var syncs atomic.Int32
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		syncs.Add(1)
+		_, _ = w.Write([]byte("[]"))
+	}))
+	defer peer.Close()
+
+	stop := New(time.Minute).SyncWith(peer.URL, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	stop()
+	time.Sleep(20 * time.Millisecond) // 等待已经发出的请求结束
+	n := syncs.Load()
+	time.Sleep(50 * time.Millisecond)
+	if n < 2 || syncs.Load() != n {
+		t.Fatalf("expect periodic syncs until stopped, got %d then %d", n, syncs.Load())
+	}
+}
+
+func TestRegistrySyncWithHungPeer(t *testing.T) {
+	release := make(chan struct{})
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer peer.Close()
+	defer close(release)
+	r := New(time.Minute)
+	r.syncClient.Timeout = 50 * time.Millisecond
+
+	// 对方没有响应时第一次同步超时返回，而不是一直阻塞
+	done := make(chan func())
+	go func() { done <- r.SyncWith(peer.URL, time.Hour) }()
+	select {
+	case stop := <-done:
+		stop()
+	case <-time.After(time.Second):
+		t.Fatal("SyncWith should return once the sync times out")
+	}
+}
+
+func TestRegistryMergeSavesOnlyChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	r := New(time.Minute, path)
+	r.persistDelay = 10 * time.Millisecond
+	items := []ServerItem{{Addr: "tcp@127.0.0.1:9001", Start: time.Now()}}
+	r.merge(items)
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// 合并相同的服务列表不会重写文件
+	r.merge(items)
+	time.Sleep(50 * time.Millisecond)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("merging unchanged servers should not save the file, got %v", err)
+	}
+}
+
+func TestDeregister(t *testing.T) {
+	r := New(time.Minute)
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	if err := sendHeartbeat(context.Background(), s.URL, "tcp@127.0.0.1:9001", nil); err != nil {
+		t.Fatal(err)
+	}
+	r.putServer("tcp@127.0.0.1:9002")
+	if err := Deregister(s.URL, "tcp@127.0.0.1:9001"); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.listAliveServers(); !reflect.DeepEqual(got, []string{"tcp@127.0.0.1:9002"}) {
+		t.Fatalf("expect only the other server to be left, got %v", got)
+	}
+	// 缺少地址时返回错误
+	if err := Deregister(s.URL, ""); err == nil {
+		t.Fatal("expect an error without the server address")
+	}
+}
+
+func TestRegistryPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	r := New(time.Minute, path)
+	r.persistDelay = 10 * time.Millisecond
+	r.putServer("tcp@127.0.0.1:9001")
+	r.putServer("tcp@127.0.0.1:9002")
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	// 重启后从文件恢复服务列表
+	restarted := New(time.Minute, path)
+	want := []string{"tcp@127.0.0.1:9001", "tcp@127.0.0.1:9002"}
+	if got := restarted.listAliveServers(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expect the servers to survive a restart, got %v", got)
+	}
+
+	// 已经超时的服务不会被恢复
+	expired := []ServerItem{
+		{Addr: "tcp@127.0.0.1:9001", Start: time.Now().Add(-2 * time.Minute)},
+		{Addr: "tcp@127.0.0.1:9002", Start: time.Now()},
+	}
+	data, _ := json.Marshal(expired)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	restarted = New(time.Minute, path)
+	if got := restarted.listAliveServers(); !reflect.DeepEqual(got, []string{"tcp@127.0.0.1:9002"}) {
+		t.Fatalf("expect the timed out server to be dropped, got %v", got)
+	}
+}
+
+// flakyRegistry accepts heartbeats, except the requests numbered in fail
+type flakyRegistry struct {
+	requests atomic.Int32
+	fail     func(n int32) bool
+}
+
+func (f *flakyRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if f.fail(f.requests.Add(1)) {
+		http.Error(w, "registry unavailable", http.StatusServiceUnavailable)
+	}
+}
+
+func TestHeartbeatRetry(t *testing.T) {
+	// 第 2、3 次心跳失败，之后恢复，心跳应当继续发送
+	flaky := &flakyRegistry{fail: func(n int32) bool { return n == 2 || n == 3 }}
+	s := httptest.NewServer(flaky)
+	defer s.Close()
+	defer HeartbeatWithRetry(s.URL, "tcp@127.0.0.1:9001", 20*time.Millisecond, 3)()
+	deadline := time.Now().Add(2 * time.Second)
+	for flaky.requests.Load() < 6 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := flaky.requests.Load(); n < 6 {
+		t.Fatalf("heartbeats should go on after transient failures, got %d requests", n)
+	}
+
+	// 连续失败达到阈值后停止
+	down := &flakyRegistry{fail: func(n int32) bool { return n > 1 }}
+	s2 := httptest.NewServer(down)
+	defer s2.Close()
+	HeartbeatWithRetry(s2.URL, "tcp@127.0.0.1:9002", 20*time.Millisecond, 2)
+	time.Sleep(200 * time.Millisecond)
+	if n := down.requests.Load(); n != 3 {
+		t.Fatalf("expect the initial heartbeat and 2 failures, got %d requests", n)
+	}
+}
+
+func TestHeartbeatStop(t *testing.T) {
+	r := New(time.Minute)
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	stop := Heartbeat(s.URL, "tcp@127.0.0.1:9001", 20*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	// 停止心跳后注销，之后不会再被心跳重新注册
+	stop()
+	if err := Deregister(s.URL, "tcp@127.0.0.1:9001"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if got := r.listAliveServers(); len(got) != 0 {
+		t.Fatalf("expect no server after stopping heartbeats and deregistering, got %v", got)
+	}
+}
+
+func TestHeartbeatHungRegistry(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// 第一次心跳成功，之后注册中心接受连接但不再响应
+		if requests.Add(1) > 1 {
+			<-release
+		}
+	}))
+	defer s.Close()
+	defer close(release)
+
+	// 心跳请求在 interval 的一半后超时，按失败处理并重试，达到上限后停止
+	stop := HeartbeatWithRetry(s.URL, "tcp@127.0.0.1:9001", 40*time.Millisecond, 2)
+	defer stop()
+	deadline := time.Now().Add(2 * time.Second)
+	for requests.Load() < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := requests.Load(); n != 3 {
+		t.Fatalf("expect the initial heartbeat and 2 timed out retries, got %d requests", n)
+	}
+}
+
+func TestRegistryMetadata(t *testing.T) {
+	r := New(time.Minute)
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	meta := map[string]string{"weight": "5", "zone": "us-east"}
+	if err := sendHeartbeat(context.Background(), s.URL, "tcp@127.0.0.1:9001", meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendHeartbeat(context.Background(), s.URL, "tcp@127.0.0.1:9002", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	var items []ServerItem
+	if err := json.NewDecoder(resp.Body).Decode(&items); err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || !reflect.DeepEqual(items[0].Metadata, meta) || items[1].Metadata != nil {
+		t.Fatalf("expect the metadata in the JSON response, got %+v", items)
+	}
+	// header 中的地址列表保持不变
+	if got := resp.Header.Get(HeaderGetAllServersList); got != "tcp@127.0.0.1:9001,tcp@127.0.0.1:9002" {
+		t.Fatalf("unexpected server list header %q", got)
+	}
+}
+
+func TestRegistryLongPoll(t *testing.T) {
+	r := New(time.Minute)
+	s := httptest.NewServer(r)
+	defer s.Close()
+	r.putServer("tcp@127.0.0.1:9001")
+
+	get := func(query string) (*http.Response, time.Duration) {
+		start := time.Now()
+		resp, err := http.Get(s.URL + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp, time.Since(start)
+	}
+	resp, _ := get("")
+	version := resp.Header.Get(HeaderRegistryVersion)
+	if version != "1" {
+		t.Fatalf("expect version 1 after a server is added, got %q", version)
+	}
+
+	// 版本没有变化时阻塞到 wait 结束，心跳不改变版本
+	r.putServer("tcp@127.0.0.1:9001")
+	resp, elapsed := get("?wait=100ms&since=" + version)
+	if elapsed < 100*time.Millisecond || resp.Header.Get(HeaderRegistryVersion) != version {
+		t.Fatalf("expect to block for the wait, got %s, version %q", elapsed, resp.Header.Get(HeaderRegistryVersion))
+	}
+
+	// 服务列表变化时立即返回
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		r.putServer("tcp@127.0.0.1:9002")
+	}()
+	resp, elapsed = get("?wait=5s&since=" + version)
+	if elapsed > time.Second || resp.Header.Get(HeaderRegistryVersion) != "2" ||
+		resp.Header.Get(HeaderGetAllServersList) != "tcp@127.0.0.1:9001,tcp@127.0.0.1:9002" {
+		t.Fatalf("expect to return on the change, got %s, version %q, servers %q",
+			elapsed, resp.Header.Get(HeaderRegistryVersion), resp.Header.Get(HeaderGetAllServersList))
+	}
+}
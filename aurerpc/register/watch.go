@@ -0,0 +1,67 @@
+package register
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HeaderRegistryVersion 注册中心服务列表的版本号，服务列表（地址或元数据）每次变化时递增
+// 长轮询请求 GET ?wait=30s&since=<version>：版本号仍等于 since 时阻塞，直到服务列表变化或者等待 wait
+const HeaderRegistryVersion = "X-Aurerpc-Registry-Version"
+
+// maxWatchWait is the longest a long-poll request is blocked
+const maxWatchWait = 5 * time.Minute
+
+// bumpVersion increments the version and wakes up the long-poll requests, r.mu must be held
+func (r *Registry) bumpVersion() {
+	r.version++
+	if r.changed != nil {
+		close(r.changed)
+		r.changed = nil
+	}
+}
+
+// waitChange blocks until the version differs from since, wait has passed or ctx is done.
+// 超时的服务只在列出服务列表时移除，因此等待期间服务超时不会唤醒等待者，最多延迟 wait
+func (r *Registry) waitChange(ctx context.Context, since uint64, wait time.Duration) {
+	r.mu.Lock()
+	if r.version != since {
+		r.mu.Unlock()
+		return
+	}
+	if r.changed == nil {
+		r.changed = make(chan struct{})
+	}
+	changed := r.changed
+	r.mu.Unlock()
+
+	timer := time.NewTimer(min(wait, maxWatchWait))
+	defer timer.Stop()
+	select {
+	case <-changed:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// parseWatch parses the wait and since query parameters of a long-poll request
+func parseWatch(req *http.Request) (since uint64, wait time.Duration, ok bool) {
+	query := req.URL.Query()
+	wait, err := time.ParseDuration(query.Get("wait"))
+	if err != nil || wait <= 0 {
+		return 0, 0, false
+	}
+	since, err = strconv.ParseUint(query.Get("since"), 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return since, wait, true
+}
+
+func (r *Registry) currentVersion() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.version
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -21,7 +22,7 @@ const debugText = `<html>
 		<th align=center>Method</th><th align=center>Calls</th>
 		{{range $name, $mtype := .Method}}
 			<tr>
-			<td align=left font=fixed>{{$name}}({{$mtype.ArgType}}, {{$mtype.ReplyType}}) error</td>
+			<td align=left font=fixed>{{$name}}({{if $mtype.WithContext}}context.Context, {{end}}{{$mtype.ArgType}}, {{$mtype.ReplyType}}) error</td>
 			<td align=center>{{$mtype.NumCalls}}</td>
 			</tr>
 		{{end}}
@@ -62,11 +63,48 @@ func (server debugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// methodMetrics is the JSON form of the metrics of a method
+type methodMetrics struct {
+	Calls           uint64 `json:"calls"`
+	TotalDurationNs int64  `json:"total_duration_ns"`
+	LastDurationNs  int64  `json:"last_duration_ns"`
+}
+
+// debugMetrics serves the metrics of all methods as JSON, {service: {method: metrics}}
+type debugMetrics struct {
+	*Server
+}
+
+// Runs at /debug/aurerpc/metrics.json
+func (server debugMetrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	metrics := make(map[string]map[string]methodMetrics)
+	server.serviceMap.Range(func(namei, svci any) bool {
+		svc := svci.(*service)
+		methods := make(map[string]methodMetrics, len(svc.method))
+		for name, mtype := range svc.method {
+			methods[name] = methodMetrics{
+				Calls:           mtype.NumCalls(),
+				TotalDurationNs: int64(mtype.TotalDuration()),
+				LastDurationNs:  int64(mtype.LastDuration()),
+			}
+		}
+		metrics[namei.(string)] = methods
+		return true
+	})
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(metrics); err != nil {
+		log.Println("[RPC server]: encode metrics error:", err)
+	}
+}
+
 func (server *Server) HandleHTTPDebug() {
 	// 注册路由处理 RPC 请求
 	http.Handle(constants.DefaultRPCPath, server)
 	// 注册路由处理调试请求
 	http.Handle(constants.DefaultDebugPath, debugHTTP{server})
+	http.Handle(constants.DefaultMetricsPath, debugMetrics{server})
+	http.Handle(constants.DefaultInflightPath, debugInflight{Server: server})
+	http.Handle(constants.DefaultInflightPath+".json", debugInflight{Server: server, json: true})
 	log.Println("[RPC server] debug path:", constants.DefaultDebugPath)
 }
 
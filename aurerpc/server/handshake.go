@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+)
+
+// HandshakeCode is a machine-readable reason why the server rejected a connection.
+type HandshakeCode string
+
+const (
+	HandshakeBadMagic     HandshakeCode = "bad_magic"
+	HandshakeBadVersion   HandshakeCode = "bad_version"
+	HandshakeBadCodec     HandshakeCode = "bad_codec"
+	HandshakeBadCompress  HandshakeCode = "bad_compress"
+	HandshakeBadChecksum  HandshakeCode = "bad_checksum"
+	HandshakeUnauthorized HandshakeCode = "unauthorized"
+)
+
+// HandshakeError 服务端拒绝连接时，代替 Option 回复给客户端的错误
+// 握手阶段固定使用 JSON 编码，因此错误帧与 codec 无关：
+// {"HandshakeError":{"Code":"bad_magic","Message":"invalid magic number: 1"}}
+type HandshakeError struct {
+	Code    HandshakeCode
+	Message string
+}
+
+// Errors for each HandshakeCode, use errors.Is to check the reason of a rejection.
+var (
+	ErrBadMagicNumber     = &HandshakeError{Code: HandshakeBadMagic}
+	ErrUnsupportedVersion = &HandshakeError{Code: HandshakeBadVersion}
+	ErrInvalidCodec       = &HandshakeError{Code: HandshakeBadCodec}
+	ErrInvalidCompress    = &HandshakeError{Code: HandshakeBadCompress}
+	ErrInvalidChecksum    = &HandshakeError{Code: HandshakeBadChecksum}
+	ErrUnauthorized       = &HandshakeError{Code: HandshakeUnauthorized}
+)
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("rpc handshake rejected (%s): %s", e.Code, e.Message)
+}
+
+// Is reports whether target is a HandshakeError with the same code
+func (e *HandshakeError) Is(target error) bool {
+	t, ok := target.(*HandshakeError)
+	return ok && t.Code == e.Code
+}
+
+// HandshakeReply is the answer of the server to the Option sent by the client,
+// it is the echoed Option, or only a HandshakeError when the connection is rejected.
+type HandshakeReply struct {
+	*Option
+	HandshakeError *HandshakeError `json:",omitempty"`
+}
+
+// reject logs the reason and sends the handshake error frame to the client
+func reject(conn io.Writer, code HandshakeCode, format string, v ...any) {
+	msg := fmt.Sprintf(format, v...)
+	log.Println("[RPC server]:", msg)
+	reply := HandshakeReply{HandshakeError: &HandshakeError{Code: code, Message: msg}}
+	if err := json.NewEncoder(conn).Encode(&reply); err != nil {
+		log.Println("[RPC server]: send handshake error: ", err)
+	}
+}
+
+// handshakeConn reads the bytes the json.Decoder of the Option read beyond it
+// before reading from the connection, writes and closes go to the connection directly
+type handshakeConn struct {
+	io.Reader
+	io.ReadWriteCloser
+}
+
+func (c *handshakeConn) Read(p []byte) (int, error) {
+	return c.Reader.Read(p)
+}
+
+// afterOption returns conn with the bytes dec has buffered beyond the Option put back,
+// the client may send the Option and the first request in one write, then the decoder
+// reads a part of the request into its buffer, which would be lost if the codec read conn.
+// json.Encoder 在 Option 之后写入一个换行符，它不属于请求，需要去掉；
+// 换行符可能还没有被读取（在之后的数据包中到达），此时在第一次读取连接时去掉
+func afterOption(dec *json.Decoder, conn io.ReadWriteCloser) io.ReadWriteCloser {
+	rest, _ := io.ReadAll(dec.Buffered())
+	if len(rest) == 0 {
+		return &handshakeConn{Reader: &newlineSkipper{r: conn}, ReadWriteCloser: conn}
+	}
+	rest = bytes.TrimPrefix(rest, []byte("\n"))
+	if len(rest) == 0 {
+		return conn
+	}
+	return &handshakeConn{Reader: io.MultiReader(bytes.NewReader(rest), conn), ReadWriteCloser: conn}
+}
+
+// newlineSkipper drops the newline after the Option if it's the first byte read from r.
+// 不能在握手时同步读取这个字节：不发送换行符的客户端要等到服务端回复 Option 之后才发送请求
+type newlineSkipper struct {
+	r       io.Reader
+	checked bool
+}
+
+func (s *newlineSkipper) Read(p []byte) (int, error) {
+	for {
+		n, err := s.r.Read(p)
+		if s.checked || n == 0 {
+			return n, err
+		}
+		s.checked = true
+		if p[0] != '\n' {
+			return n, err
+		}
+		n = copy(p, p[1:n])
+		if n > 0 || err != nil {
+			return n, err
+		}
+		// 只读到了换行符，继续读取请求
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+var _ io.ReadWriteCloser = (*trackedConn)(nil)
+
+// trackedConn 记录连接最近一次读写的时间和正在处理的请求数，供空闲连接回收使用
+type trackedConn struct {
+	io.ReadWriteCloser
+	lastActive atomic.Int64 // unix nano of the last read or write
+	inflight   atomic.Int64 // requests being handled
+}
+
+func (c *trackedConn) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+func (c *trackedConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *trackedConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+// idle reports whether the connection has no request in flight
+// and no activity for longer than timeout
+func (c *trackedConn) idle(timeout time.Duration) bool {
+	return c.inflight.Load() == 0 &&
+		time.Since(time.Unix(0, c.lastActive.Load())) > timeout
+}
+
+// trackConn registers conn in the server until the returned connection is untracked
+func (server *Server) trackConn(conn io.ReadWriteCloser) *trackedConn {
+	tc := &trackedConn{ReadWriteCloser: conn}
+	tc.touch()
+	server.conns.Store(tc, struct{}{})
+	return tc
+}
+
+func (server *Server) untrackConn(tc *trackedConn) {
+	server.conns.Delete(tc)
+}
+
+// SetIdleTimeout 开启空闲连接回收：没有正在处理的请求，并且超过 timeout 没有读写的连接会被关闭
+// 防止客户端建立连接后不发送数据（slow-loris）耗尽服务端资源，timeout <= 0 时关闭回收
+func (server *Server) SetIdleTimeout(timeout time.Duration) {
+	server.idleTimeout.Store(int64(timeout))
+	server.reaperOnce.Do(func() { go server.reapIdleConns() })
+}
+
+// ReapedConns returns the number of connections closed for being idle
+func (server *Server) ReapedConns() int64 {
+	return server.reaped.Load()
+}
+
+// reapIdleConns checks the connections periodically, the interval is half of the idle timeout,
+// it exits once the server is shut down.
+func (server *Server) reapIdleConns() {
+	for {
+		timeout := time.Duration(server.idleTimeout.Load())
+		interval := timeout / 2
+		if timeout <= 0 {
+			interval = time.Second
+		}
+		select {
+		case <-server.done:
+			return
+		case <-time.After(interval):
+		}
+		if timeout <= 0 {
+			continue
+		}
+		server.conns.Range(func(key, _ any) bool {
+			tc := key.(*trackedConn)
+			if tc.idle(timeout) {
+				server.untrackConn(tc)
+				server.reaped.Add(1)
+				log.Printf("[RPC server]: close connection idle for more than %s", timeout)
+				_ = tc.Close()
+			}
+			return true
+		})
+	}
+}
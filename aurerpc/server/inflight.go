@@ -0,0 +1,101 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// InflightRequest describes a request being handled by the server
+type InflightRequest struct {
+	Service    string        `json:"service"`
+	Method     string        `json:"method"`
+	Seq        uint64        `json:"seq"`
+	RemoteAddr string        `json:"remote_addr"`
+	Elapsed    time.Duration `json:"elapsed_ns"`
+	start      time.Time
+}
+
+// trackRequest records req as in flight until the returned func is called
+func (server *Server) trackRequest(req *request, conn *trackedConn) func() {
+	service, method, _ := strings.Cut(req.h.ServiceMethod, ".")
+	server.inflightReqs.Store(req, &InflightRequest{
+		Service:    service,
+		Method:     method,
+		Seq:        req.h.Seq,
+		RemoteAddr: conn.remoteAddr(),
+		start:      time.Now(),
+	})
+	return func() { server.inflightReqs.Delete(req) }
+}
+
+// InflightRequests returns the requests being handled, the longest running first
+func (server *Server) InflightRequests() []InflightRequest {
+	var reqs []InflightRequest
+	server.inflightReqs.Range(func(_, v any) bool {
+		r := *v.(*InflightRequest)
+		r.Elapsed = time.Since(r.start)
+		reqs = append(reqs, r)
+		return true
+	})
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].Elapsed > reqs[j].Elapsed })
+	return reqs
+}
+
+// remoteAddr returns the address of the peer, or "" if the connection isn't a net.Conn
+func (c *trackedConn) remoteAddr() string {
+	if nc, ok := c.ReadWriteCloser.(net.Conn); ok && nc.RemoteAddr() != nil {
+		return nc.RemoteAddr().String()
+	}
+	return ""
+}
+
+const inflightText = `<html>
+	<body>
+	<title>AureRPC In-flight Requests</title>
+		<table>
+		<th align=center>Service</th><th align=center>Method</th><th align=center>Seq</th><th align=center>Remote</th><th align=center>Elapsed</th>
+		{{range .}}
+			<tr>
+			<td align=left>{{.Service}}</td>
+			<td align=left>{{.Method}}</td>
+			<td align=center>{{.Seq}}</td>
+			<td align=left>{{.RemoteAddr}}</td>
+			<td align=right>{{.Elapsed}}</td>
+			</tr>
+		{{end}}
+		</table>
+	</body>
+	</html>`
+
+var inflightTemplate = template.Must(template.New("RPC inflight").Parse(inflightText))
+
+// debugInflight lists the in-flight requests as HTML, or as JSON if json is true
+type debugInflight struct {
+	*Server
+	json bool
+}
+
+// Runs at /debug/aurerpc/inflight and /debug/aurerpc/inflight.json
+func (server debugInflight) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	reqs := server.InflightRequests()
+	if server.json {
+		w.Header().Set("Content-Type", "application/json")
+		if reqs == nil {
+			reqs = []InflightRequest{}
+		}
+		if err := json.NewEncoder(w).Encode(reqs); err != nil {
+			log.Println("[RPC server]: encode in-flight requests error:", err)
+		}
+		return
+	}
+	if err := inflightTemplate.Execute(w, reqs); err != nil {
+		_, _ = fmt.Fprintln(w, "rpc: error executing template:", err.Error())
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// propagatedKeys 需要随请求传递的 context key，metadata 中的名称 -> key
+var propagatedKeys sync.Map
+
+// PropagateContextKeys 注册需要自动传递的 context key（例如 trace id）
+// 客户端调用时从 ctx 中取出这些 key 的值放入 Header.Metadata，
+// 服务端再将它们放回传给方法的 context 中，方法的第一个参数需要是 context.Context
+//
+// 值以 fmt.Sprint 的结果传递，因此服务端取到的值是 string 类型
+// 客户端和服务端都需要注册相同的 key
+func PropagateContextKeys(keys ...any) {
+	for _, key := range keys {
+		propagatedKeys.Store(metadataName(key), key)
+	}
+}
+
+// metadataName returns the name of key in Header.Metadata,
+// the type is included so that keys of different types don't collide
+func metadataName(key any) string {
+	return fmt.Sprintf("%T:%v", key, key)
+}
+
+// ContextMetadata extracts the values of the propagated keys from ctx
+func ContextMetadata(ctx context.Context) map[string]string {
+	var md map[string]string
+	propagatedKeys.Range(func(name, key any) bool {
+		if v := ctx.Value(key); v != nil {
+			if md == nil {
+				md = make(map[string]string)
+			}
+			md[name.(string)] = fmt.Sprint(v)
+		}
+		return true
+	})
+	return md
+}
+
+type metadataKey struct{}
+
+// MetadataFromContext returns all metadata sent along with the request,
+// ctx is the context passed to the method.
+func MetadataFromContext(ctx context.Context) map[string]string {
+	md, _ := ctx.Value(metadataKey{}).(map[string]string)
+	return md
+}
+
+// contextWithMetadata puts the values of the propagated keys in md back into ctx
+func contextWithMetadata(ctx context.Context, md map[string]string) context.Context {
+	if len(md) == 0 {
+		return ctx
+	}
+	ctx = context.WithValue(ctx, metadataKey{}, md)
+	for name, value := range md {
+		if key, ok := propagatedKeys.Load(name); ok {
+			ctx = context.WithValue(ctx, key, value)
+		}
+	}
+	return ctx
+}
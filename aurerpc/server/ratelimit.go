@@ -0,0 +1,58 @@
+package server
+
+import (
+	"errors"
+	"time"
+)
+
+var errRateLimited = errors.New("[RPC server]: rate limited")
+
+// rateLimit is the setting of SetRateLimit
+type rateLimit struct {
+	rps   int
+	burst int
+}
+
+// SetRateLimit 限制每个连接每秒处理的请求数，使用令牌桶算法，允许 burst 个请求的突发。
+// 超出限制的请求不排队，立即回复 "rate limited" 错误；只对之后建立的连接生效。
+// rps <= 0 表示不限制（默认），burst 小于 1 时按 1 处理
+func (server *Server) SetRateLimit(rps int, burst int) {
+	if rps <= 0 {
+		server.rateLimit.Store(nil)
+		return
+	}
+	server.rateLimit.Store(&rateLimit{rps: rps, burst: max(burst, 1)})
+}
+
+// newTokenBucket returns the token bucket of a new connection, nil means unlimited
+func (server *Server) newTokenBucket() *tokenBucket {
+	limit := server.rateLimit.Load()
+	if limit == nil {
+		return nil
+	}
+	return &tokenBucket{
+		rate:   float64(limit.rps),
+		burst:  float64(limit.burst),
+		tokens: float64(limit.burst),
+		last:   time.Now(),
+	}
+}
+
+// tokenBucket 令牌以 rate 个每秒的速度放入桶中，桶中最多 burst 个，每个请求消耗一个。
+// 只在连接的读取协程中使用，不需要加锁
+type tokenBucket struct {
+	rate, burst float64
+	tokens      float64
+	last        time.Time
+}
+
+// allow reports whether a request can be handled at now, and takes a token if so
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
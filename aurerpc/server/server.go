@@ -15,11 +15,16 @@
  *
  * 一次连接中：
  * |Option|Header1|Body1|Header2|Body2|...
+ *
+ * 协议版本 2 起，Header 和 Body 之前各有 4 字节大端序的长度：
+ * |Option|len|Header1|len|Body1|len|Header2|len|Body2|...
  */
 
 package server
 
 import (
+	"context"
+	"encoding/gob"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -28,40 +33,137 @@ import (
 	"net"
 	"net/http"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"aurerpc/codec"
 	"aurerpc/constants"
 )
 
-const MagicNumber = 0x3bef5c
+const (
+	MagicNumber = 0x3bef5c
+	// ProtocolVersion is the newest wire protocol version the server speaks.
+	// 后续修改报文格式（分帧、压缩等）时递增该版本号，服务端据此拒绝无法处理的连接
+	// version 1: header 和 body 直接写入连接
+	// version 2: header 和 body 使用长度前缀分帧，见 codec/frame.go
+	ProtocolVersion = 2
+	// MinProtocolVersion is the oldest wire protocol version the server still speaks.
+	MinProtocolVersion = 1
+)
 
 // RPC 连接建立时确定是否是对应的RPC协议，编码方式，超时时间
 type Option struct {
-	MagicNumber int        // MagicNumber marks this is aureRPC request
-	CodecType   codec.Type // client choose which codec to use
+	MagicNumber     int                // MagicNumber marks this is aureRPC request
+	ProtocolVersion uint8              // wire protocol version, 0 means a peer that predates versioning (version 1)
+	CodecType       codec.Type         // client choose which codec to use
+	CompressType    codec.CompressType `json:",omitempty"` // compression of the connection after the handshake, none by default
+	Checksum        bool               `json:",omitempty"` // append a CRC32 checksum to each frame, requires protocol version 2
+	// 连接上同时处理的请求数上限，超出的请求等待空闲后再处理（不会被丢弃），0 表示不限制
+	MaxConcurrentRequests int `json:",omitempty"`
+	// 连接的认证凭据，由 Server.SetAuthFunc 设置的函数校验，服务端回复的 Option 中不包含它
+	Token string `json:",omitempty"`
 
 	// add timeout handle
 	ConnectTimeout time.Duration // 0 means no limit
 	HandleTimeout  time.Duration
+
+	// client-only settings, not sent to the server
+	LazyReceive     bool `json:"-"` // start the receive goroutine on the first call instead of on creation
+	MaxPendingCalls int  `json:"-"` // calls waiting for a response beyond this are rejected, 0 means no limit
+	// Reconnect re-dials the server on the next call after the connection drops,
+	// it only works for clients created by Dial, DialHTTP and XDial.
+	Reconnect        bool          `json:"-"`
+	ReconnectBackoff time.Duration `json:"-"` // wait after a failed reconnect before trying again, doubled on each failure, 0 means 100ms
 }
 
 var DefaultOption = &Option{
-	MagicNumber:    MagicNumber,
-	CodecType:      codec.GobType,
-	ConnectTimeout: time.Second * 10,
+	MagicNumber:     MagicNumber,
+	ProtocolVersion: ProtocolVersion,
+	CodecType:       codec.GobType,
+	ConnectTimeout:  time.Second * 10,
+}
+
+// version returns the protocol version of the option,
+// peers which don't send a version speak version 1.
+func (opt *Option) version() uint8 {
+	if opt.ProtocolVersion == 0 {
+		return 1
+	}
+	return opt.ProtocolVersion
 }
 
 // Server represents a server.
 type Server struct {
 	serviceMap sync.Map
+	ready      chan struct{} // closed once Accept has begun
+	readyOnce  sync.Once
+
+	conns       sync.Map     // *trackedConn -> struct{}, connections being served
+	idleTimeout atomic.Int64 // time.Duration, see SetIdleTimeout
+	reaperOnce  sync.Once
+	reaped      atomic.Int64 // connections closed for being idle
+
+	maxHandleTimeout atomic.Int64 // time.Duration, see SetMaxHandleTimeout
+	caseInsensitive  atomic.Bool  // see SetCaseInsensitive
+
+	authFunc atomic.Pointer[func(token string) bool] // see SetAuthFunc
+
+	malformed    atomic.Int64 // requests whose service method is ill-formed
+	maxMalformed atomic.Int64 // see SetMaxMalformedRequests
+
+	inflightReqs sync.Map // *request -> *InflightRequest, see InflightRequests
+
+	rateLimit atomic.Pointer[rateLimit] // see SetRateLimit
+
+	listeners    sync.Map      // net.Listener -> struct{}, listeners being accepted, closed by Shutdown
+	done         chan struct{} // closed once Shutdown is called
+	shutdownOnce sync.Once
 }
 
 // NewServer returns a new Server.
 func NewServer() *Server {
-	return &Server{}
+	return &Server{ready: make(chan struct{}), done: make(chan struct{})}
+}
+
+// Ready returns a channel which is closed once the server has begun accepting
+// connections, use it instead of sleeping before dialing the server.
+func (server *Server) Ready() <-chan struct{} {
+	return server.ready
+}
+
+// SetMaxHandleTimeout 设置服务端允许的最大处理超时时间
+// 客户端在 Option 中提出的 HandleTimeout 超过 limit（或为 0，即不限制）时会被限制为 limit，
+// 限制后的值通过握手回复给客户端。limit <= 0 表示不限制，使用客户端提出的值
+func (server *Server) SetMaxHandleTimeout(limit time.Duration) {
+	server.maxHandleTimeout.Store(int64(limit))
+}
+
+// SetAuthFunc 设置连接的认证函数，握手时用客户端 Option 中的 Token 调用 f，
+// 返回 false 时拒绝连接，不再处理任何请求。f 为 nil 表示不认证（默认）
+func (server *Server) SetAuthFunc(f func(token string) bool) {
+	if f == nil {
+		server.authFunc.Store(nil)
+		return
+	}
+	server.authFunc.Store(&f)
+}
+
+// authorized reports whether token passes the auth func of the server
+func (server *Server) authorized(token string) bool {
+	f := server.authFunc.Load()
+	return f == nil || (*f)(token)
+}
+
+// clampHandleTimeout limits the handle timeout proposed by the client to the server's max
+func (server *Server) clampHandleTimeout(timeout time.Duration) time.Duration {
+	limit := time.Duration(server.maxHandleTimeout.Load())
+	if limit > 0 && (timeout <= 0 || timeout > limit) {
+		return limit
+	}
+	return timeout
 }
 
 // DefaultServer is the default instance of Server.
@@ -69,12 +171,22 @@ var DefaultServer = NewServer()
 
 // Accept accepts connections on the listener and serves requests
 // for each incoming connection.
+// Accept returns once Shutdown is called.
 func (server *Server) Accept(lis net.Listener) {
+	server.readyOnce.Do(func() { close(server.ready) })
+	if !server.trackListener(lis) {
+		return
+	}
+	defer server.listeners.Delete(lis)
 	// for 循环等待 socket 连接建立，并开启子协程处理
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
-			log.Println("[RPC server]: accept error:", err)
+			select {
+			case <-server.done: // the listener is closed by Shutdown
+			default:
+				log.Println("[RPC server]: accept error:", err)
+			}
 			return
 		}
 		go server.ServeConn(conn)
@@ -95,31 +207,62 @@ func Accept(lis net.Listener) {
 // ServeConn blocks, serving the connection until the client hangs up.
 // ServeConn 在单个连接上运行服务器
 // ServeConn 阻塞，为连接提供服务直到客户端挂起
-func (server *Server) ServeConn(conn io.ReadWriteCloser) {
+func (server *Server) ServeConn(rwc io.ReadWriteCloser) {
+	conn := server.trackConn(rwc)
+	defer server.untrackConn(conn)
 	// 明确表示了对 Close() 返回值的处理方式，同时避免了潜在的编译警告
 	defer func() { _ = conn.Close() }()
+	if server.shuttingDown() {
+		return
+	}
 	var opt Option
-	if err := json.NewDecoder(conn).Decode(&opt); err != nil {
+	dec := json.NewDecoder(conn)
+	if err := dec.Decode(&opt); err != nil {
 		log.Println("[RPC server]: receive options error:", err)
 		return
 	}
 
+	// 拒绝连接时先回复错误帧再关闭连接，客户端可以得知被拒绝的原因
 	if opt.MagicNumber != MagicNumber {
-		log.Printf("[RPC server]: invalid magic number: %x", opt.MagicNumber)
+		reject(conn, HandshakeBadMagic, "invalid magic number: %x", opt.MagicNumber)
 		return
 	}
-	f := codec.NewCodecFuncMap[opt.CodecType]
+	if v := opt.version(); v < MinProtocolVersion || v > ProtocolVersion {
+		reject(conn, HandshakeBadVersion, "unsupported protocol version %d, expect %d~%d", v, MinProtocolVersion, ProtocolVersion)
+		return
+	}
+	// 不记录 token 本身，避免凭据出现在日志中
+	if !server.authorized(opt.Token) {
+		reject(conn, HandshakeUnauthorized, "invalid token")
+		return
+	}
+	f := codec.CodecFunc(opt.CodecType, opt.version())
 	if f == nil {
-		log.Printf("[RPC server]: invalid codec type %s", opt.CodecType)
+		reject(conn, HandshakeBadCodec, "invalid codec type %s", opt.CodecType)
+		return
+	}
+	// 解码 Option 时多读取的字节属于之后的请求，交给 codec 继续读取
+	rwc, err := codec.WrapCompress(afterOption(dec, conn), opt.CompressType)
+	if err != nil {
+		reject(conn, HandshakeBadCompress, "%v", err)
 		return
 	}
+	cc := f(rwc)
+	if opt.Checksum {
+		if err := codec.EnableChecksum(cc); err != nil {
+			reject(conn, HandshakeBadChecksum, "%v", err)
+			return
+		}
+	}
+	opt.HandleTimeout = server.clampHandleTimeout(opt.HandleTimeout)
+	opt.Token = ""
 	// 第二次握手
 	if err := json.NewEncoder(conn).Encode(&opt); err != nil {
 		log.Println("[RPC server]: send options error: ", err)
 		return
 	}
 	// 解析 opt 无误后，
-	server.serveCodec(f(conn), &opt)
+	server.serveCodec(cc, &opt, conn)
 }
 
 var invalidRequest = struct{}{}
@@ -128,25 +271,69 @@ var invalidRequest = struct{}{}
 // 2. 处理请求是并发的，但是回复请求的报文必须是逐个发送的，并发容易导致多个回复报文交织在一起，
 // 客户端无法解析。在这里使用锁（sending）保证
 // 3. 只有在header解析失败时，才终止循环
-func (server *Server) serveCodec(cc codec.Codec, opts *Option) {
+func (server *Server) serveCodec(cc codec.Codec, opts *Option, conn *trackedConn) {
 	sending := new(sync.Mutex) // make sure to send a complete response
 	wg := new(sync.WaitGroup)  // wait until all request are handled
+	malformed := int64(0)      // ill-formed requests received on the connection
+	// 限制同时处理的请求数，占满时阻塞读取新的请求
+	var slots chan struct{}
+	if opts.MaxConcurrentRequests > 0 {
+		slots = make(chan struct{}, opts.MaxConcurrentRequests)
+	}
+	bucket := server.newTokenBucket() // nil means no rate limit
 	// for 无限制地等待请求的到来，直到发生错误（连接被关闭，接收到的报文有问题）
 	for {
 		// 1. 读取请求
 		req, err := server.readRequest(cc)
 		if err != nil {
-			if req == nil {
+			// Shutdown 打断了读取，不再读取新的请求，等待处理中的请求回复后关闭连接
+			if req == nil || server.shuttingDown() {
 				break // it's not possible to recover, so close the connection
 			}
+			if errors.Is(err, errIllFormed) {
+				server.malformed.Add(1)
+				malformed++
+				if limit := server.maxMalformed.Load(); limit > 0 && malformed > limit {
+					log.Printf("[RPC server]: close connection after %d ill-formed requests, last %q\n", malformed, req.h.ServiceMethod)
+					break
+				}
+				log.Printf("[RPC server]: ill-formed service method %q\n", req.h.ServiceMethod)
+			}
+			if req.h.Oneway {
+				log.Printf("[RPC server]: drop oneway request %s: %v\n", req.h.ServiceMethod, err)
+				continue
+			}
 			req.h.Error = err.Error()
 			// 3. 回复请求
 			server.sendResponse(cc, req.h, invalidRequest, sending)
 			continue
 		}
+		// 超出速率限制的请求立即回复错误，不排队等待
+		if bucket != nil && !bucket.allow(time.Now()) {
+			if !req.h.Oneway {
+				req.h.Error = errRateLimited.Error()
+				server.sendResponse(cc, req.h, invalidRequest, sending)
+			}
+			continue
+		}
+		if slots != nil {
+			slots <- struct{}{}
+		}
 		wg.Add(1)
+		// 处理中的请求可能很久才回复，连接不算空闲
+		conn.inflight.Add(1)
 		// 2. 处理请求
-		go server.handleRequest(cc, req, sending, wg, opts.HandleTimeout)
+		go func() {
+			defer conn.inflight.Add(-1)
+			untrack := server.trackRequest(req, conn)
+			// 超时响应发送后方法可能仍在执行，方法返回时才释放名额，并移出处理中的请求
+			server.handleRequest(cc, req, sending, wg, opts.HandleTimeout, func() {
+				untrack()
+				if slots != nil {
+					<-slots
+				}
+			})
+		}()
 	}
 	wg.Wait()
 	_ = cc.Close()
@@ -158,6 +345,8 @@ type request struct {
 	argv, replyv reflect.Value // argv and replyv of request
 	mtype        *MethodType
 	svc          *service
+	ctx          context.Context // carries the metadata values propagated by the client
+	deadline     time.Time       // deadline of the client's call, zero if it has none
 }
 
 func (server *Server) readRequestHeader(cc codec.Codec) (*codec.Header, error) {
@@ -177,8 +366,16 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 		return nil, err
 	}
 	req := &request{h: h}
+	req.ctx = contextWithMetadata(context.Background(), h.Metadata)
+	h.Metadata = nil // the header is reused by the response, don't send the metadata back
+	if h.Deadline != 0 {
+		req.deadline = time.Unix(0, h.Deadline)
+		h.Deadline = 0
+	}
 	req.svc, req.mtype, err = server.findService(h.ServiceMethod)
 	if err != nil {
+		// 丢弃请求的 body，否则下一次会把它当作 header 读取，导致连接被关闭
+		_ = cc.ReadBody(nil)
 		return req, err
 	}
 	req.argv = req.mtype.newArgv()
@@ -205,13 +402,41 @@ func (server *Server) sendResponse(cc codec.Codec, h *codec.Header, body any, se
 	}
 }
 
+// returned is called once the method returns, which may be after the timeout response is sent.
 func (server *Server) handleRequest(cc codec.Codec, req *request, sending *sync.Mutex,
-	wg *sync.WaitGroup, timeout time.Duration) {
+	wg *sync.WaitGroup, timeout time.Duration, returned func()) {
 	defer wg.Done()
-	called := make(chan struct{})
-	sent := make(chan struct{})
+	// 客户端的调用有截止时间时，方法的 context 带上这个截止时间，超时时间取服务端和客户端限制中较小的一个
+	// 超时响应发送后方法可能仍在执行，由执行方法的协程在方法返回后取消 context
+	cancel := context.CancelFunc(func() {})
+	if !req.deadline.IsZero() {
+		req.ctx, cancel = context.WithDeadline(req.ctx, req.deadline)
+		if remain := max(time.Until(req.deadline), time.Nanosecond); timeout == 0 || remain < timeout {
+			timeout = remain
+		}
+	}
+	// oneway 请求不需要回复，客户端也不会等待，因此超时也没有意义
+	if req.h.Oneway {
+		defer returned()
+		defer cancel()
+		if err := req.svc.call(req.ctx, req.mtype, req.argv, req.replyv); err != nil {
+			log.Printf("[RPC server]: oneway request %s failed: %v\n", req.h.ServiceMethod, err)
+		}
+		return
+	}
+	// 带缓冲的信道，即使没有人接收（例如超时响应已经发送），工作协程也不会阻塞在发送上
+	called := make(chan struct{}, 1)
+	sent := make(chan struct{}, 1)
+	// 每个请求只回复一次：超时响应发送之后，迟到的正常响应直接丢弃
+	// 先 CAS 成功的一方负责回复
+	replied := new(atomic.Bool)
 	go func() {
-		err := req.svc.call(req.mtype, req.argv, req.replyv)
+		err := req.svc.call(req.ctx, req.mtype, req.argv, req.replyv)
+		cancel()
+		returned()
+		if !replied.CompareAndSwap(false, true) {
+			return // the timeout response has been sent
+		}
 		called <- struct{}{}
 		if err != nil {
 			req.h.Error = err.Error()
@@ -231,9 +456,14 @@ func (server *Server) handleRequest(cc codec.Codec, req *request, sending *sync.
 
 	select {
 	case <-time.After(timeout):
-		// TODO: 超时的情况下，上面新开的协程如果继续写入了called和sent，会导致这两个channel阻塞
-		req.h.Error = fmt.Sprintf("[RPC server]: request handle timeout: expect within %s", timeout)
-		server.sendResponse(cc, req.h, invalidRequest, sending)
+		if replied.CompareAndSwap(false, true) {
+			req.h.Error = fmt.Sprintf("[RPC server]: request handle timeout: expect within %s", timeout)
+			server.sendResponse(cc, req.h, invalidRequest, sending)
+			return
+		}
+		// the method finished just before the timeout and is replying
+		<-called
+		<-sent
 	case <-called:
 		<-sent
 	}
@@ -241,42 +471,114 @@ func (server *Server) handleRequest(cc codec.Codec, req *request, sending *sync.
 
 // Register published in the server the set of methods
 func (server *Server) Register(rcvr any) error {
-	s := newService(rcvr)
+	s, err := newService(rcvr)
+	if err != nil {
+		return err
+	}
 	if _, dup := server.serviceMap.LoadOrStore(s.name, s); dup {
 		return fmt.Errorf("rpc: service already defined: %s", s.name)
 	}
 	return nil
 }
 
+// ReplaceMethod replaces the implementation of a registered method with fn at runtime,
+// fn has the signature of the method without the receiver, e.g. func(args Args, reply *int) error.
+// 正在进行的调用不受影响，之后的调用使用 fn，例如用于 A/B 测试
+func (server *Server) ReplaceMethod(serviceMethod string, fn any) error {
+	_, mType, err := server.findService(serviceMethod)
+	if err != nil {
+		return err
+	}
+	return mType.replace(fn)
+}
+
 // Register publishes the receiver's methods in the DefaultServer.
 func Register(rcvr any) error {
 	return DefaultServer.Register(rcvr)
 }
 
+// RegisterGobType records the concrete type of v for gob encoding, see gob.Register.
+// 使用 gob 编码时，args 或 reply 中接口类型字段背后的具体类型必须先注册，
+// 并且客户端和服务端都需要注册，否则调用会在运行时失败
+func RegisterGobType(v any) {
+	gob.Register(v)
+}
+
+// Methods returns all callable "Service.Method" names of the server, sorted
+func (server *Server) Methods() []string {
+	var methods []string
+	server.serviceMap.Range(func(_, v any) bool {
+		svc := v.(*service)
+		for name := range svc.method {
+			methods = append(methods, svc.name+"."+name)
+		}
+		return true
+	})
+	sort.Strings(methods)
+	return methods
+}
+
+var errIllFormed = errors.New("[RPC server]: service/method request ill-formed")
+
+// SetMaxMalformedRequests 设置单个连接允许的格式错误（没有 "."）的 serviceMethod 请求数
+// 超过 limit 时关闭该连接，用于断开行为异常的客户端；limit <= 0 表示不限制，只回复错误
+func (server *Server) SetMaxMalformedRequests(limit int) {
+	server.maxMalformed.Store(int64(limit))
+}
+
+// MalformedRequests returns the number of requests with an ill-formed service method
+func (server *Server) MalformedRequests() int64 {
+	return server.malformed.Load()
+}
+
 // findService 通过 serviceMethod 从 serviceMap 中找到对应的 service
 func (server *Server) findService(serviceMethod string) (svc *service, mType *MethodType, err error) {
 	// 分割服务名和方法名
 	dot := strings.LastIndex(serviceMethod, ".")
 	if dot < 0 {
-		err = errors.New("[RPC server]: service/method request ill-formed: " + serviceMethod)
+		err = fmt.Errorf("%w: %s", errIllFormed, serviceMethod)
 		return
 	}
 	serviceName, methodName := serviceMethod[:dot], serviceMethod[dot+1:]
 
 	// 先在 serviceMap 中找到对应的 service 实例，再从 service 实例的 method 中，找到对应的 methodType
 	svci, ok := server.serviceMap.Load(serviceName)
+	if !ok && server.caseInsensitive.Load() {
+		svci, ok = server.findServiceFold(serviceName)
+	}
 	if !ok {
 		err = errors.New("[RPC server]: can't find service " + serviceName)
 		return
 	}
 	svc = svci.(*service)
 	mType = svc.method[methodName]
+	if mType == nil && server.caseInsensitive.Load() {
+		mType = svc.findMethodFold(methodName)
+	}
 	if mType == nil {
 		err = errors.New("[RPC server]: can't find method " + methodName)
 	}
 	return
 }
 
+// SetCaseInsensitive 开启后，精确匹配失败时忽略大小写查找服务和方法，例如 foo.sum 可以调用 Foo.Sum
+// 默认关闭，只做精确匹配
+func (server *Server) SetCaseInsensitive(enabled bool) {
+	server.caseInsensitive.Store(enabled)
+}
+
+// findServiceFold finds the service whose name equals name ignoring case
+func (server *Server) findServiceFold(name string) (svci any, ok bool) {
+	server.serviceMap.Range(func(k, v any) bool {
+		if strings.EqualFold(k.(string), name) {
+			svci, ok = v, true
+			return false
+		}
+		return true
+	})
+	return
+}
+
 // ----------------------- HTTP --------------------------------
 
 // ServeHTTP implements an http.Handler that answers RPC requests.
@@ -0,0 +1,379 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"aurerpc/codec"
+)
+
+// handshake sends opt to a fresh connection of server and returns
+// the option echoed back by the server, or the handshake error.
+func handshake(server *Server, opt *Option) (net.Conn, *Option, error) {
+	cli, srv := net.Pipe()
+	go server.ServeConn(srv)
+	if err := json.NewEncoder(cli).Encode(opt); err != nil {
+		return cli, nil, err
+	}
+	var echo Option
+	reply := HandshakeReply{Option: &echo}
+	if err := json.NewDecoder(cli).Decode(&reply); err != nil {
+		return cli, nil, err
+	}
+	if reply.HandshakeError != nil {
+		return cli, nil, reply.HandshakeError
+	}
+	return cli, &echo, nil
+}
+
+func TestServeConnProtocolVersion(t *testing.T) {
+	s := NewServer()
+	t.Run("matching version", func(t *testing.T) {
+		conn, echo, err := handshake(s, &Option{MagicNumber: MagicNumber, CodecType: codec.GobType, ProtocolVersion: ProtocolVersion})
+		defer func() { _ = conn.Close() }()
+		_assert(err == nil && echo.ProtocolVersion == ProtocolVersion, "handshake should succeed: %v", err)
+	})
+	t.Run("legacy peer without version", func(t *testing.T) {
+		conn, _, err := handshake(s, &Option{MagicNumber: MagicNumber, CodecType: codec.GobType})
+		defer func() { _ = conn.Close() }()
+		_assert(err == nil, "version 0 should be treated as version 1: %v", err)
+	})
+	t.Run("too new version", func(t *testing.T) {
+		conn, _, err := handshake(s, &Option{MagicNumber: MagicNumber, CodecType: codec.GobType, ProtocolVersion: ProtocolVersion + 1})
+		defer func() { _ = conn.Close() }()
+		_assert(errors.Is(err, ErrUnsupportedVersion), "server should reject a too new protocol version, got %v", err)
+	})
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	s := NewServer()
+	s.SetIdleTimeout(100 * time.Millisecond)
+	conn, _, err := handshake(s, &Option{MagicNumber: MagicNumber, CodecType: codec.GobType})
+	_assert(err == nil, "handshake should succeed: %v", err)
+	defer func() { _ = conn.Close() }()
+
+	// 握手后不再发送任何数据，连接应在空闲超时后被服务端关闭
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	_assert(errors.Is(err, io.EOF), "idle connection should be closed by the server, got %v", err)
+	_assert(s.ReapedConns() == 1, "expect 1 reaped connection, got %d", s.ReapedConns())
+
+	// Shutdown 之后回收协程退出
+	_assert(s.Shutdown(context.Background()) == nil, "shutdown should succeed")
+	reaping := func() bool {
+		buf := make([]byte, 1<<20)
+		return strings.Contains(string(buf[:runtime.Stack(buf, true)]), "reapIdleConns")
+	}
+	for i := 0; reaping(); i++ {
+		_assert(i < 100, "the reaper should exit after shutdown")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type Slow int
+
+func (s Slow) Sleep(d time.Duration, reply *int) error {
+	time.Sleep(d)
+	*reply = 1
+	return nil
+}
+
+func TestServerDropLateReply(t *testing.T) {
+	s := NewServer()
+	_ = s.Register(new(Slow))
+	conn, _, err := handshake(s, &Option{MagicNumber: MagicNumber, ProtocolVersion: ProtocolVersion, CodecType: codec.GobType, HandleTimeout: 100 * time.Millisecond})
+	_assert(err == nil, "handshake should succeed: %v", err)
+	defer func() { _ = conn.Close() }()
+
+	// 方法在超时之后很快完成，客户端只应收到一个超时响应
+	cc := codec.NewGobCodec(conn)
+	go func() { _ = cc.Write(&codec.Header{ServiceMethod: "Slow.Sleep", Seq: 1}, 150*time.Millisecond) }()
+	var h codec.Header
+	_assert(cc.ReadHeader(&h) == nil, "expect a response")
+	_assert(h.Seq == 1 && strings.Contains(h.Error, "handle timeout"), "expect the timeout response, got %+v", h)
+	_ = cc.ReadBody(nil)
+
+	_ = conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	err = cc.ReadHeader(&h)
+	_assert(errors.Is(err, os.ErrDeadlineExceeded), "the late reply should be dropped, got %+v %v", h, err)
+}
+
+func TestServerHandleTimeoutNoLeak(t *testing.T) {
+	s := NewServer()
+	_ = s.Register(new(Slow))
+	before := runtime.NumGoroutine()
+
+	conn, _, err := handshake(s, &Option{MagicNumber: MagicNumber, ProtocolVersion: ProtocolVersion, CodecType: codec.GobType, HandleTimeout: 20 * time.Millisecond})
+	_assert(err == nil, "handshake should succeed: %v", err)
+	cc := codec.NewGobCodec(conn)
+	const n = 10
+	go func() {
+		for i := range n {
+			_ = cc.Write(&codec.Header{ServiceMethod: "Slow.Sleep", Seq: uint64(i + 1)}, 50*time.Millisecond)
+		}
+	}()
+	for range n {
+		var h codec.Header
+		_assert(cc.ReadHeader(&h) == nil && strings.Contains(h.Error, "handle timeout"), "expect a timeout response, got %+v", h)
+		_ = cc.ReadBody(nil)
+	}
+	_ = conn.Close()
+
+	// 方法在超时之后返回，工作协程应当全部退出
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	_assert(runtime.NumGoroutine() <= before, "goroutines leaked: %d before, %d after", before, runtime.NumGoroutine())
+}
+
+func TestServerMaxMalformedRequests(t *testing.T) {
+	s := NewServer()
+	s.SetMaxMalformedRequests(3)
+	conn, _, err := handshake(s, &Option{MagicNumber: MagicNumber, ProtocolVersion: ProtocolVersion, CodecType: codec.GobType})
+	_assert(err == nil, "handshake should succeed: %v", err)
+	defer func() { _ = conn.Close() }()
+
+	cc := codec.NewGobCodec(conn)
+	go func() {
+		for i := range 4 {
+			_ = cc.Write(&codec.Header{ServiceMethod: "NoDot", Seq: uint64(i + 1)}, 1)
+		}
+	}()
+	// 前 3 个请求收到错误响应，第 4 个请求超过阈值，连接被关闭
+	for i := range 3 {
+		var h codec.Header
+		_assert(cc.ReadHeader(&h) == nil && h.Seq == uint64(i+1), "expect response %d, got %+v", i+1, h)
+		_assert(strings.Contains(h.Error, "ill-formed"), "expect an ill-formed error, got %q", h.Error)
+		_ = cc.ReadBody(nil)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	var h codec.Header
+	err = cc.ReadHeader(&h)
+	_assert(errors.Is(err, io.EOF), "connection should be dropped after the threshold, got %+v %v", h, err)
+	_assert(s.MalformedRequests() == 4, "expect 4 malformed requests, got %d", s.MalformedRequests())
+}
+
+// Concurrent records the max number of Sleep calls running at the same time
+type Concurrent struct {
+	active, max atomic.Int32
+}
+
+func (c *Concurrent) Sleep(d time.Duration, reply *int) error {
+	n := c.active.Add(1)
+	defer c.active.Add(-1)
+	for {
+		if m := c.max.Load(); n <= m || c.max.CompareAndSwap(m, n) {
+			break
+		}
+	}
+	time.Sleep(d)
+	return nil
+}
+
+func TestServerMaxConcurrentRequests(t *testing.T) {
+	s := NewServer()
+	c := new(Concurrent)
+	_ = s.Register(c)
+	conn, echo, err := handshake(s, &Option{MagicNumber: MagicNumber, ProtocolVersion: ProtocolVersion, CodecType: codec.GobType, MaxConcurrentRequests: 2})
+	_assert(err == nil && echo.MaxConcurrentRequests == 2, "handshake should succeed: %v", err)
+	defer func() { _ = conn.Close() }()
+
+	cc := codec.NewGobCodec(conn)
+	const n = 6
+	go func() {
+		for i := range n {
+			_ = cc.Write(&codec.Header{ServiceMethod: "Concurrent.Sleep", Seq: uint64(i + 1)}, 30*time.Millisecond)
+		}
+	}()
+	// 超出上限的请求等待而不是被丢弃，所有请求都会收到回复
+	for range n {
+		var h codec.Header
+		_assert(cc.ReadHeader(&h) == nil && h.Error == "", "expect a response, got %+v", h)
+		_ = cc.ReadBody(nil)
+	}
+	_assert(c.max.Load() == 2, "expect at most 2 concurrent handlers, got %d", c.max.Load())
+}
+
+func TestServerMaxConcurrentRequestsWithTimeout(t *testing.T) {
+	s := NewServer()
+	c := new(Concurrent)
+	_ = s.Register(c)
+	opt := &Option{MagicNumber: MagicNumber, ProtocolVersion: ProtocolVersion, CodecType: codec.GobType,
+		MaxConcurrentRequests: 2, HandleTimeout: 10 * time.Millisecond}
+	conn, _, err := handshake(s, opt)
+	_assert(err == nil, "handshake should succeed: %v", err)
+	defer func() { _ = conn.Close() }()
+
+	cc := codec.NewGobCodec(conn)
+	const n = 6
+	go func() {
+		for i := range n {
+			_ = cc.Write(&codec.Header{ServiceMethod: "Concurrent.Sleep", Seq: uint64(i + 1)}, 50*time.Millisecond)
+		}
+	}()
+	// 超时响应发送后方法仍在执行，名额直到方法返回才释放
+	for range n {
+		var h codec.Header
+		_assert(cc.ReadHeader(&h) == nil && strings.Contains(h.Error, "timeout"), "expect a timeout response, got %+v", h)
+		_ = cc.ReadBody(nil)
+	}
+	_assert(c.max.Load() == 2, "expect at most 2 concurrent handlers, got %d", c.max.Load())
+}
+
+func TestServerInflightRequests(t *testing.T) {
+	s := NewServer()
+	_ = s.Register(new(Slow))
+	conn, _, err := handshake(s, &Option{MagicNumber: MagicNumber, ProtocolVersion: ProtocolVersion, CodecType: codec.GobType})
+	_assert(err == nil, "handshake should succeed: %v", err)
+	defer func() { _ = conn.Close() }()
+
+	cc := codec.NewGobCodec(conn)
+	go func() { _ = cc.Write(&codec.Header{ServiceMethod: "Slow.Sleep", Seq: 7}, 200*time.Millisecond) }()
+	deadline := time.Now().Add(time.Second)
+	for len(s.InflightRequests()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	debugInflight{Server: s, json: true}.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/aurerpc/inflight.json", nil))
+	var reqs []InflightRequest
+	_ = json.Unmarshal(w.Body.Bytes(), &reqs)
+	_assert(len(reqs) == 1 && reqs[0].Service == "Slow" && reqs[0].Method == "Sleep" && reqs[0].Seq == 7,
+		"expect the slow request in flight, got %s", w.Body.String())
+	w = httptest.NewRecorder()
+	debugInflight{Server: s}.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/aurerpc/inflight", nil))
+	_assert(strings.Contains(w.Body.String(), "<td align=left>Sleep</td>"), "expect the slow request in the HTML view:\n%s", w.Body.String())
+
+	var h codec.Header
+	_assert(cc.ReadHeader(&h) == nil && h.Seq == 7, "expect the response, got %+v", h)
+	_ = cc.ReadBody(nil)
+	// 回复之后请求不再处于处理中
+	deadline = time.Now().Add(time.Second)
+	for len(s.InflightRequests()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	_assert(len(s.InflightRequests()) == 0, "expect no request in flight, got %+v", s.InflightRequests())
+
+	// 超时响应发送后方法仍在执行，请求仍然处于处理中，直到方法返回
+	s.SetMaxHandleTimeout(20 * time.Millisecond)
+	conn2, _, err := handshake(s, &Option{MagicNumber: MagicNumber, ProtocolVersion: ProtocolVersion, CodecType: codec.GobType})
+	_assert(err == nil, "handshake should succeed: %v", err)
+	defer func() { _ = conn2.Close() }()
+	cc = codec.NewGobCodec(conn2)
+	go func() { _ = cc.Write(&codec.Header{ServiceMethod: "Slow.Sleep", Seq: 8}, 200*time.Millisecond) }()
+	h = codec.Header{}
+	_assert(cc.ReadHeader(&h) == nil && strings.Contains(h.Error, "timeout"), "expect a timeout response, got %+v", h)
+	_ = cc.ReadBody(nil)
+	reqs = s.InflightRequests()
+	_assert(len(reqs) == 1 && reqs[0].Seq == 8, "expect the timed out request still in flight, got %+v", reqs)
+	deadline = time.Now().Add(time.Second)
+	for len(s.InflightRequests()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	_assert(len(s.InflightRequests()) == 0, "expect no request in flight once the method returns, got %+v", s.InflightRequests())
+}
+
+// bufferConn buffers everything written to it
+type bufferConn struct {
+	bytes.Buffer
+}
+
+func (c *bufferConn) Close() error { return nil }
+
+func TestServeConnCoalescedRequests(t *testing.T) {
+	s := NewServer()
+	_ = s.Register(new(Foo))
+	for _, codecType := range []codec.Type{codec.GobType, codec.JsonType} {
+		t.Run(string(codecType), func(t *testing.T) {
+			conn, _, err := handshake(s, &Option{MagicNumber: MagicNumber, ProtocolVersion: ProtocolVersion, CodecType: codecType})
+			_assert(err == nil, "handshake should succeed: %v", err)
+			defer func() { _ = conn.Close() }()
+
+			// 两个请求编码到同一个缓冲区，再通过一次 Write 发送
+			var requests bufferConn
+			w := codec.NewCodecFuncMap[codecType](&requests)
+			_ = w.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, &Args{Num1: 1, Num2: 2})
+			_ = w.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 2}, &Args{Num1: 3, Num2: 4})
+			go func() { _, _ = conn.Write(requests.Bytes()) }()
+
+			cc := codec.NewCodecFuncMap[codecType](conn)
+			replies := make(map[uint64]int)
+			for range 2 {
+				var h codec.Header
+				var reply int
+				_assert(cc.ReadHeader(&h) == nil && h.Error == "", "read header failed: %+v", h)
+				_assert(cc.ReadBody(&reply) == nil, "read body failed")
+				replies[h.Seq] = reply
+			}
+			_assert(replies[1] == 3 && replies[2] == 7, "wrong replies: %v", replies)
+		})
+	}
+}
+
+func TestServeConnOptionAndRequestInOneWrite(t *testing.T) {
+	s := NewServer()
+	_ = s.Register(new(Foo))
+	for _, codecType := range []codec.Type{codec.GobType, codec.JsonType} {
+		t.Run(string(codecType), func(t *testing.T) {
+			cli, srv := net.Pipe()
+			go s.ServeConn(srv)
+			defer func() { _ = cli.Close() }()
+
+			// Option 和第一个请求通过一次 Write 发送，服务端解码 Option 时会多读取请求的一部分
+			var buf bufferConn
+			_ = json.NewEncoder(&buf).Encode(&Option{MagicNumber: MagicNumber, ProtocolVersion: ProtocolVersion, CodecType: codecType})
+			w := codec.NewCodecFuncMap[codecType](&buf)
+			_ = w.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, &Args{Num1: 1, Num2: 2})
+			go func() { _, _ = cli.Write(buf.Bytes()) }()
+
+			dec := json.NewDecoder(cli)
+			var echo Option
+			_assert(dec.Decode(&HandshakeReply{Option: &echo}) == nil, "handshake failed")
+			cc := codec.NewCodecFuncMap[codecType](afterOption(dec, cli))
+			var h codec.Header
+			var reply int
+			_assert(cc.ReadHeader(&h) == nil && h.Seq == 1 && h.Error == "", "read header failed: %+v", h)
+			_assert(cc.ReadBody(&reply) == nil && reply == 3, "expect 3, got %d", reply)
+		})
+	}
+}
+
+func TestServeConnOptionNewlineInLaterWrite(t *testing.T) {
+	s := NewServer()
+	_ = s.Register(new(Foo))
+	cli, srv := net.Pipe()
+	go s.ServeConn(srv)
+	defer func() { _ = cli.Close() }()
+
+	// Option 之后的换行符和第一个请求一起在之后到达，不能被 codec 当作请求的一部分读取
+	var buf bufferConn
+	_ = json.NewEncoder(&buf).Encode(&Option{MagicNumber: MagicNumber, ProtocolVersion: ProtocolVersion, CodecType: codec.GobType})
+	option := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+	go func() { _, _ = cli.Write(option) }()
+	dec := json.NewDecoder(cli)
+	var echo Option
+	_assert(dec.Decode(&HandshakeReply{Option: &echo}) == nil, "handshake failed")
+
+	var req bufferConn
+	_, _ = req.Write([]byte("\n"))
+	_ = codec.NewGobCodec(&req).Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, &Args{Num1: 1, Num2: 2})
+	go func() { _, _ = cli.Write(req.Bytes()) }()
+	cc := codec.NewGobCodec(afterOption(dec, cli))
+	var h codec.Header
+	var reply int
+	_assert(cc.ReadHeader(&h) == nil && h.Seq == 1 && h.Error == "", "read header failed: %+v", h)
+	_assert(cc.ReadBody(&reply) == nil && reply == 3, "expect 3, got %d", reply)
+}
@@ -1,10 +1,15 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"go/ast"
 	"log"
 	"reflect"
+	"runtime"
+	"strings"
 	"sync/atomic"
+	"time"
 )
 
 // 方法
@@ -13,6 +18,13 @@ type MethodType struct {
 	ArgType   reflect.Type   // 第一个参数类型
 	ReplyType reflect.Type   // 第二个参数类型
 	numCalls  uint64         // 后续统计方法调用次数
+	// 调用耗时的累计值和最近一次的值，单位纳秒
+	totalDuration atomic.Int64
+	lastDuration  atomic.Int64
+	// 方法的第一个参数是否是 context.Context，是则调用时传入请求的 context
+	withContext bool
+	// ReplaceMethod 设置的函数，不为 nil 时代替 method 被调用，调用时不传入接收者
+	replacement atomic.Pointer[reflect.Value]
 }
 
 func (m *MethodType) NumCalls() uint64 {
@@ -20,6 +32,21 @@ func (m *MethodType) NumCalls() uint64 {
 	return atomic.LoadUint64(&m.numCalls)
 }
 
+// TotalDuration returns the cumulative time spent in the method
+func (m *MethodType) TotalDuration() time.Duration {
+	return time.Duration(m.totalDuration.Load())
+}
+
+// LastDuration returns the time spent in the last finished call of the method
+func (m *MethodType) LastDuration() time.Duration {
+	return time.Duration(m.lastDuration.Load())
+}
+
+// WithContext reports whether the method takes a context.Context as its first argument
+func (m *MethodType) WithContext() bool {
+	return m.withContext
+}
+
 func (m *MethodType) newArgv() reflect.Value {
 	var argv reflect.Value
 	// reflect.Elem() 获取一个指针类型的值所指向的具体类型
@@ -53,6 +80,39 @@ func (m *MethodType) newReplyv() reflect.Value {
 	return replyv
 }
 
+// replace validates that the signature of fn matches the method without the receiver,
+// and makes fn called instead of the method.
+func (m *MethodType) replace(fn any) error {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func || v.IsNil() {
+		return fmt.Errorf("[RPC server]: replacement of %s must be a non-nil func, got %T", m.method.Name, fn)
+	}
+	// 与原方法去掉接收者之后的签名一致
+	want := []reflect.Type{m.ArgType, m.ReplyType}
+	if m.withContext {
+		want = []reflect.Type{typeOfContext, m.ArgType, m.ReplyType}
+	}
+	t := v.Type()
+	ok := t.NumIn() == len(want) && t.NumOut() == 1 && t.Out(0) == typeOfError && !t.IsVariadic()
+	for i := 0; ok && i < len(want); i++ {
+		ok = t.In(i) == want[i]
+	}
+	if !ok {
+		return fmt.Errorf("[RPC server]: replacement of %s has signature %s, expect func%s error", m.method.Name, t, signature(want))
+	}
+	m.replacement.Store(&v)
+	return nil
+}
+
+// signature formats types as a parameter list, e.g. (int, *int)
+func signature(types []reflect.Type) string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = t.String()
+	}
+	return "(" + strings.Join(names, ", ") + ")"
+}
+
 // 服务
 type service struct {
 	name   string                 // 映射的结构体的名称
@@ -62,7 +122,8 @@ type service struct {
 }
 
 // newService 构造函数，根据入参的结构体实例创建对应的服务
-func newService(rcvr any) *service {
+// 服务名不合法时返回错误，而不是直接退出进程
+func newService(rcvr any) (*service, error) {
 	s := new(service)
 	s.rcvr = reflect.ValueOf(rcvr)
 	// reflect.Indirect() ->
@@ -73,10 +134,10 @@ func newService(rcvr any) *service {
 	s.name = reflect.Indirect(s.rcvr).Type().Name()
 	s.typ = reflect.TypeOf(rcvr)
 	if !ast.IsExported(s.name) {
-		log.Fatalf("[RPC server]: %s is not a valid service name", s.name)
+		return nil, fmt.Errorf("[RPC server]: %s is not a valid service name", s.name)
 	}
 	s.registerMethods()
-	return s
+	return s, nil
 }
 
 // registerMethods 注册结构体中符合条件的方法
@@ -85,36 +146,84 @@ func (s *service) registerMethods() {
 	for i := 0; i < s.typ.NumMethod(); i++ {
 		method := s.typ.Method(i)
 		mType := method.Type
-		// 两个导出或内置类型的入参（反射时为3个，第0个是自身）
+		// 两个导出或内置类型的入参（反射时为3个，第0个是自身），可以额外有一个 context.Context 作为第一个参数
 		// 返回值有且只有一个，且类型为 error
-		if mType.NumIn() != 3 || mType.NumOut() != 1 {
+		withContext := mType.NumIn() == 4 && mType.In(1) == typeOfContext
+		if (mType.NumIn() != 3 && !withContext) || mType.NumOut() != 1 {
 			continue
 		}
-		if mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
+		if mType.Out(0) != typeOfError {
 			continue
 		}
-		argType, replyType := mType.In(1), mType.In(2)
+		argIndex := 1
+		if withContext {
+			argIndex = 2
+		}
+		argType, replyType := mType.In(argIndex), mType.In(argIndex+1)
 		if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
 			continue
 		}
+		// reply 必须是指针，否则 newReplyv 无法创建 reply，并且方法也无法把结果写回
+		if replyType.Kind() != reflect.Pointer {
+			log.Printf("[RPC server]: skip %s.%s: reply type %s is not a pointer\n", s.name, method.Name, replyType)
+			continue
+		}
 		s.method[method.Name] = &MethodType{
-			method:    method,
-			ArgType:   argType,
-			ReplyType: replyType,
+			method:      method,
+			ArgType:     argType,
+			ReplyType:   replyType,
+			withContext: withContext,
 		}
 		log.Printf("[RPC server]: register %s.%s\n", s.name, method.Name)
 	}
 }
 
+// findMethodFold finds the method whose name equals name ignoring case
+func (s *service) findMethodFold(name string) *MethodType {
+	for methodName, mType := range s.method {
+		if strings.EqualFold(methodName, name) {
+			return mType
+		}
+	}
+	return nil
+}
+
 // 检测这个类型是否是导出的类型或内建的类型
 func isExportedOrBuiltinType(t reflect.Type) bool {
 	return ast.IsExported(t.Name()) || t.PkgPath() == ""
 }
 
-func (s *service) call(m *MethodType, argv, replyv reflect.Value) error {
+var (
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// call invokes the method, ctx is passed as the first argument if the method accepts it.
+// 方法 panic 时恢复并记录调用栈，panic 作为错误返回给客户端，不会导致服务端崩溃
+func (s *service) call(ctx context.Context, m *MethodType, argv, replyv reflect.Value) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := make([]byte, 4096)
+			stack = stack[:runtime.Stack(stack, false)]
+			log.Printf("[RPC server]: %s.%s panic recovered: %v\n%s", s.name, m.method.Name, r, stack)
+			err = fmt.Errorf("[RPC server]: %s.%s panic: %v", s.name, m.method.Name, r)
+		}
+	}()
 	atomic.AddUint64(&m.numCalls, 1)
 	f := m.method.Func
-	returnValues := f.Call([]reflect.Value{s.rcvr, argv, replyv})
+	in := []reflect.Value{s.rcvr, argv, replyv}
+	if m.withContext {
+		in = []reflect.Value{s.rcvr, reflect.ValueOf(ctx), argv, replyv}
+	}
+	// 原子地读取替换的函数，并发的调用要么使用旧的实现，要么使用新的实现
+	if fn := m.replacement.Load(); fn != nil {
+		f, in = *fn, in[1:]
+	}
+	start := time.Now()
+	returnValues := f.Call(in)
+	d := time.Since(start)
+	m.totalDuration.Add(int64(d))
+	m.lastDuration.Store(int64(d))
 	if errInter := returnValues[0].Interface(); errInter != nil {
 		return errInter.(error)
 	}
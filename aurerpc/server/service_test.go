@@ -1,8 +1,14 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -31,7 +37,8 @@ func _assert(condition bool, msg string, v ...any) {
 
 func TestNewService(t *testing.T) {
 	var foo Foo
-	s := newService(&foo)
+	s, err := newService(&foo)
+	_assert(err == nil, "newService failed: %v", err)
 	_assert(len(s.method) == 1, "wrong service Method, expect 1, but got %d", len(s.method))
 	mType := s.method["Sum"]
 	_assert(mType != nil, "wrong Method, Sum should not be nil")
@@ -39,12 +46,169 @@ func TestNewService(t *testing.T) {
 
 func TestMethodType_Call(t *testing.T) {
 	var foo Foo
-	s := newService(&foo)
+	s, _ := newService(&foo)
 	mType := s.method["Sum"]
 
 	argv := mType.newArgv()
 	replyv := mType.newReplyv()
 	argv.Set(reflect.ValueOf(Args{Num1: 1, Num2: 3}))
-	err := s.call(mType, argv, replyv)
+	err := s.call(context.Background(), mType, argv, replyv)
 	_assert(err == nil && *replyv.Interface().(*int) == 4 && mType.NumCalls() == 1, "failed to call Foo.Sum")
 }
+
+type ctxKey struct{}
+
+type CtxFoo int
+
+func (f CtxFoo) Get(ctx context.Context, args int, reply *string) error {
+	*reply, _ = ctx.Value(ctxKey{}).(string)
+	return nil
+}
+
+func TestContextMethod(t *testing.T) {
+	s := NewServer()
+	_assert(s.Register(new(Foo)) == nil && s.Register(new(CtxFoo)) == nil, "register failed")
+
+	svc, mType, err := s.findService("CtxFoo.Get")
+	_assert(err == nil && mType.WithContext(), "CtxFoo.Get should take a context: %v", err)
+	_, plain, _ := s.findService("Foo.Sum")
+	_assert(!plain.WithContext(), "Foo.Sum should not take a context")
+
+	// 请求的 context 作为第一个参数传入
+	ctx := context.WithValue(context.Background(), ctxKey{}, "hello")
+	replyv := mType.newReplyv()
+	err = svc.call(ctx, mType, reflect.ValueOf(1), replyv)
+	_assert(err == nil && *replyv.Interface().(*string) == "hello", "expect the value of ctx, got %q %v", *replyv.Interface().(*string), err)
+
+	// debug 页面展示 context 参数
+	w := httptest.NewRecorder()
+	debugHTTP{s}.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/aurerpc", nil))
+	body := w.Body.String()
+	_assert(strings.Contains(body, "Get(context.Context, int, *string) error"), "debug page should show the context argument:\n%s", body)
+	_assert(strings.Contains(body, "Sum(server.Args, *int) error"), "debug page should show the plain signature:\n%s", body)
+}
+
+func TestDebugMetrics(t *testing.T) {
+	s := NewServer()
+	_ = s.Register(new(Foo))
+	svc, mType, _ := s.findService("Foo.Sum")
+	for range 2 {
+		_ = svc.call(context.Background(), mType, reflect.ValueOf(Args{Num1: 1, Num2: 2}), mType.newReplyv())
+	}
+
+	w := httptest.NewRecorder()
+	debugMetrics{s}.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/aurerpc/metrics.json", nil))
+	var metrics map[string]map[string]methodMetrics
+	err := json.Unmarshal(w.Body.Bytes(), &metrics)
+	_assert(err == nil, "metrics should be JSON: %v\n%s", err, w.Body.String())
+	m := metrics["Foo"]["Sum"]
+	_assert(m.Calls == 2, "expect 2 calls, got %d", m.Calls)
+	_assert(m.TotalDurationNs > 0 && m.LastDurationNs > 0 && m.LastDurationNs <= m.TotalDurationNs,
+		"unexpected durations: %+v", m)
+}
+
+// not a exported service name
+type bar int
+
+func (b bar) Sum(args Args, reply *int) error {
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+func TestRegisterUnexportedService(t *testing.T) {
+	var b bar
+	err := NewServer().Register(&b)
+	_assert(err != nil && strings.Contains(err.Error(), "not a valid service name"), "expect an invalid service name error, got %v", err)
+}
+
+type Baz int
+
+func (b Baz) Sum(args Args, reply *int) error {
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+// reply is not a pointer, the result can't be sent back
+func (b Baz) Diff(args Args, reply int) error {
+	return nil
+}
+
+func TestNewServiceNonPointerReply(t *testing.T) {
+	var b Baz
+	s, err := newService(&b)
+	_assert(err == nil, "newService failed: %v", err)
+	_assert(len(s.method) == 1 && s.method["Sum"] != nil, "only Baz.Sum should be registered, got %d methods", len(s.method))
+	server := NewServer()
+	_ = server.Register(&b)
+	_, _, err = server.findService("Baz.Diff")
+	_assert(err != nil && strings.Contains(err.Error(), "can't find method"), "Baz.Diff should not be registered")
+}
+
+func TestServerMethods(t *testing.T) {
+	s := NewServer()
+	_assert(s.Register(new(Foo)) == nil, "register Foo failed")
+	_assert(s.Register(new(Baz)) == nil, "register Baz failed")
+	methods := s.Methods()
+	// Baz.Diff 的 reply 不是指针，不会被注册
+	_assert(reflect.DeepEqual(methods, []string{"Baz.Sum", "Foo.Sum"}), "wrong methods: %v", methods)
+}
+
+func TestServerCaseInsensitive(t *testing.T) {
+	s := NewServer()
+	_ = s.Register(new(Foo))
+	_, _, err := s.findService("foo.sum")
+	_assert(err != nil, "exact matching should be the default")
+
+	s.SetCaseInsensitive(true)
+	svc, mType, err := s.findService("foo.sum")
+	_assert(err == nil && svc.name == "Foo" && mType.method.Name == "Sum", "expect Foo.Sum, got %v", err)
+}
+
+func TestReplaceMethod(t *testing.T) {
+	s := NewServer()
+	_ = s.Register(new(Foo))
+	svc, mType, _ := s.findService("Foo.Sum")
+	call := func() int {
+		argv, replyv := mType.newArgv(), mType.newReplyv()
+		argv.Set(reflect.ValueOf(Args{Num1: 1, Num2: 3}))
+		err := svc.call(context.Background(), mType, argv, replyv)
+		_assert(err == nil, "call failed: %v", err)
+		return *replyv.Interface().(*int)
+	}
+
+	err := s.ReplaceMethod("Foo.Sum", func(args Args, reply *string) error { return nil })
+	_assert(err != nil && strings.Contains(err.Error(), "signature"), "expect a signature error, got %v", err)
+	_assert(s.ReplaceMethod("Foo.Missing", func(Args, *int) error { return nil }) != nil, "expect an error for a missing method")
+
+	// 并发调用的同时替换实现，每次调用的结果要么来自旧实现，要么来自新实现
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 200 {
+				got := call()
+				_assert(got == 4 || got == 3, "unexpected reply %d", got)
+			}
+		}()
+	}
+	for i := range 50 {
+		var err error
+		if i%2 == 0 {
+			err = s.ReplaceMethod("Foo.Sum", func(args Args, reply *int) error {
+				*reply = args.Num2 - args.Num1 + 1
+				return nil
+			})
+		} else {
+			err = s.ReplaceMethod("Foo.Sum", Foo(0).Sum)
+		}
+		_assert(err == nil, "replace failed: %v", err)
+	}
+	wg.Wait()
+
+	_ = s.ReplaceMethod("Foo.Sum", func(args Args, reply *int) error {
+		*reply = args.Num1 * args.Num2 * 10
+		return nil
+	})
+	_assert(call() == 30, "expect the replacement to be called")
+}
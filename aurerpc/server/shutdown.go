@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// shutdownPollInterval is how often Shutdown checks whether all connections are closed
+const shutdownPollInterval = 10 * time.Millisecond
+
+// readDeadliner is implemented by connections whose blocked reads can be interrupted, e.g. net.Conn
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// trackListener registers lis to be closed by Shutdown,
+// it closes lis and reports false if the server is already shut down.
+func (server *Server) trackListener(lis net.Listener) bool {
+	server.listeners.Store(lis, struct{}{})
+	// Shutdown 可能在 Store 之前遍历了 listeners，这里再检查一次
+	if server.shuttingDown() {
+		server.listeners.Delete(lis)
+		_ = lis.Close()
+		return false
+	}
+	return true
+}
+
+func (server *Server) shuttingDown() bool {
+	select {
+	case <-server.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown 优雅地关闭服务端：
+// 1. 关闭所有 listener，Accept 返回，不再接受新的连接
+// 2. 打断各连接上阻塞的读取，serveCodec 不再读取新的请求
+// 3. 等待处理中的请求回复完成、连接关闭
+// 所有连接关闭后返回 nil，ctx 先结束时返回 ctx.Err()，此时仍未关闭的连接不受影响
+// 只有实现了 SetReadDeadline 的连接（例如 net.Conn）的读取可以被打断，其余连接要等客户端断开
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.shutdownOnce.Do(func() { close(server.done) })
+	server.listeners.Range(func(key, _ any) bool {
+		_ = key.(net.Listener).Close()
+		return true
+	})
+	server.conns.Range(func(key, _ any) bool {
+		if rd, ok := key.(*trackedConn).ReadWriteCloser.(readDeadliner); ok {
+			_ = rd.SetReadDeadline(time.Now())
+		}
+		return true
+	})
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if server.connCount() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// connCount returns the number of connections being served
+func (server *Server) connCount() int {
+	n := 0
+	server.conns.Range(func(_, _ any) bool {
+		n++
+		return true
+	})
+	return n
+}
@@ -0,0 +1,18 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// ServeTLS accepts connections on the listener, wraps each of them in a TLS
+// server connection using cfg and serves requests on it.
+// TLS 握手在读取 Option 之前完成，Option 交换和 codec 协商与明文连接一致
+func (server *Server) ServeTLS(lis net.Listener, cfg *tls.Config) {
+	server.Accept(tls.NewListener(lis, cfg))
+}
+
+// ServeTLS is a wrapper of DefaultServer.ServeTLS.
+func ServeTLS(lis net.Listener, cfg *tls.Config) {
+	DefaultServer.ServeTLS(lis, cfg)
+}
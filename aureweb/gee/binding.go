@@ -0,0 +1,212 @@
+package gee
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+)
+
+// Binding binds the data of a request into obj, see Context.ShouldBindWith
+type Binding interface {
+	Bind(req *http.Request, obj any) error
+}
+
+// 内置的 Binding 实现
+type (
+	// JSONBinding decodes the request body as JSON
+	JSONBinding struct{}
+	// XMLBinding decodes the request body as XML
+	XMLBinding struct{}
+	// FormBinding binds the query parameters and the (multipart) form body, using the form tag
+	FormBinding struct{}
+	// QueryBinding binds the query parameters only, the request body is never read
+	QueryBinding struct{}
+)
+
+func (JSONBinding) Bind(req *http.Request, obj any) error {
+	if req.Body == nil {
+		return errors.New("gee: missing request body")
+	}
+	return json.NewDecoder(req.Body).Decode(obj)
+}
+
+func (XMLBinding) Bind(req *http.Request, obj any) error {
+	if req.Body == nil {
+		return errors.New("gee: missing request body")
+	}
+	return xml.NewDecoder(req.Body).Decode(obj)
+}
+
+// defaultMultipartMemory 与标准库 http.Request.FormValue 使用的大小一致
+const defaultMultipartMemory = 32 << 20
+
+func (FormBinding) Bind(req *http.Request, obj any) error {
+	if err := req.ParseMultipartForm(defaultMultipartMemory); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		return err
+	}
+	return mapForm(obj, req.Form)
+}
+
+func (QueryBinding) Bind(req *http.Request, obj any) error {
+	return mapForm(obj, req.URL.Query())
+}
+
+// ShouldBindWith binds the request into obj with the given binding, ignoring Content-Type.
+// 如果请求体已经通过 GetRawData 读取过，绑定时使用缓存的内容，因此可以多次绑定
+func (c *Context) ShouldBindWith(obj any, b Binding) error {
+	if c.rawRead && c.rawData != nil {
+		c.Req.Body = io.NopCloser(bytes.NewReader(c.rawData))
+	}
+	return b.Bind(c.Req, obj)
+}
+
+// ShouldBindBodyWith is like ShouldBindWith, but the body is read through GetRawData first,
+// so that it's cached and can be bound again, e.g. by trying several bindings in turn.
+func (c *Context) ShouldBindBodyWith(obj any, b Binding) error {
+	if _, err := c.GetRawData(); err != nil {
+		return err
+	}
+	return c.ShouldBindWith(obj, b)
+}
+
+// GetRawData 读取完整的请求体并缓存，之后可以重复调用
+// 读取后 c.Req.Body 会被替换为缓存内容的 reader，标准库的 ParseForm 等仍可正常使用
+func (c *Context) GetRawData() ([]byte, error) {
+	if c.rawRead {
+		return c.rawData, nil
+	}
+	if c.Req.Body == nil {
+		c.rawRead = true
+		return nil, nil
+	}
+	data, err := io.ReadAll(c.Req.Body)
+	_ = c.Req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	c.rawData, c.rawRead = data, true
+	c.Req.Body = io.NopCloser(bytes.NewReader(data))
+	return data, nil
+}
+
+// BindJSON decodes the JSON request body into obj,
+// the body is read through GetRawData so it can be bound more than once.
+func (c *Context) BindJSON(obj any) error {
+	data, err := c.GetRawData()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, obj)
+}
+
+// Bind 根据 Content-Type 绑定请求体，目前只支持 JSON
+func (c *Context) Bind(obj any) error {
+	contentType, _, _ := mime.ParseMediaType(c.Req.Header.Get("Content-Type"))
+	switch contentType {
+	case "application/json", "":
+		return c.BindJSON(obj)
+	default:
+		return fmt.Errorf("gee: unsupported content type %q", contentType)
+	}
+}
+
+// BindQuery binds the query parameters into obj, which must be a pointer to a struct,
+// the request body is never read.
+// 字段通过 form tag 指定参数名，没有 tag 时使用字段名，tag 为 - 的字段被忽略
+func (c *Context) BindQuery(obj any) error {
+	return c.ShouldBindWith(obj, QueryBinding{})
+}
+
+// mapForm sets the fields of the struct pointed to by obj from values
+func mapForm(obj any, values url.Values) error {
+	v := reflect.ValueOf(obj)
+	if v.Kind() != reflect.Pointer || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return errors.New("gee: bind requires a non-nil pointer to a struct")
+	}
+	return mapFormStruct(v.Elem(), values)
+}
+
+func mapFormStruct(v reflect.Value, values url.Values) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, fv := t.Field(i), v.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		// 匿名嵌入的结构体，展开其中的字段
+		if field.Anonymous && fv.Kind() == reflect.Struct {
+			if err := mapFormStruct(fv, values); err != nil {
+				return err
+			}
+			continue
+		}
+		name := field.Tag.Get("form")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		vs, ok := values[name]
+		if !ok || len(vs) == 0 {
+			continue
+		}
+		if fv.Kind() == reflect.Slice {
+			slice := reflect.MakeSlice(fv.Type(), len(vs), len(vs))
+			for j, s := range vs {
+				if err := setFormValue(slice.Index(j), s); err != nil {
+					return fmt.Errorf("gee: bind %s: %w", name, err)
+				}
+			}
+			fv.Set(slice)
+			continue
+		}
+		if err := setFormValue(fv, vs[0]); err != nil {
+			return fmt.Errorf("gee: bind %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// setFormValue parses s according to the kind of v and sets it
+func setFormValue(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
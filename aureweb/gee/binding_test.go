@@ -0,0 +1,131 @@
+package gee
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGetRawDataThenBindJSON(t *testing.T) {
+	const body = `{"name":"aure","age":18}`
+	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	c := newContext(httptest.NewRecorder(), req)
+
+	// 像 webhook 一样，先读取原始数据（例如校验签名），再绑定 JSON
+	raw, err := c.GetRawData()
+	if err != nil || string(raw) != body {
+		t.Fatalf("expect raw body %q, got %q %v", body, raw, err)
+	}
+
+	var user struct {
+		Name string `json:"name"`
+		Age  int    `json:"age"`
+	}
+	if err := c.BindJSON(&user); err != nil || user.Name != "aure" || user.Age != 18 {
+		t.Fatalf("failed to bind json after GetRawData: %+v %v", user, err)
+	}
+	user.Name = ""
+	if err := c.Bind(&user); err != nil || user.Name != "aure" {
+		t.Fatalf("failed to bind twice: %+v %v", user, err)
+	}
+	// the request body can still be read by the standard library
+	if rest, _ := io.ReadAll(c.Req.Body); string(rest) != body {
+		t.Fatalf("expect the body to be restored, got %q", rest)
+	}
+}
+
+// failReader fails the test if the request body is read
+type failReader struct{ t *testing.T }
+
+func (r failReader) Read([]byte) (int, error) {
+	r.t.Fatal("BindQuery should not read the body")
+	return 0, io.EOF
+}
+
+func TestBindQuery(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/users?page=2&size=10&tag=a&tag=b", failReader{t})
+	var query struct {
+		Page   int      `form:"page"`
+		Size   uint     `form:"size"`
+		Tags   []string `form:"tag"`
+		Ignore string   `form:"-"`
+	}
+	if err := newContext(httptest.NewRecorder(), req).BindQuery(&query); err != nil {
+		t.Fatal(err)
+	}
+	if query.Page != 2 || query.Size != 10 || len(query.Tags) != 2 || query.Tags[1] != "b" {
+		t.Fatalf("wrong query binding: %+v", query)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/users?page=two", nil)
+	if err := newContext(httptest.NewRecorder(), req).BindQuery(&query); err == nil {
+		t.Fatal("expect an error for an invalid int")
+	}
+}
+
+func TestShouldBindWith(t *testing.T) {
+	type user struct {
+		Name string `json:"name" xml:"name" form:"name"`
+		Age  int    `json:"age" xml:"age" form:"age"`
+	}
+
+	// 没有 Content-Type 时，显式指定使用 JSON 绑定
+	req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(`{"name":"aure","age":18}`))
+	c := newContext(httptest.NewRecorder(), req)
+	var u user
+	if err := c.ShouldBindWith(&u, JSONBinding{}); err != nil || u.Name != "aure" || u.Age != 18 {
+		t.Fatalf("failed to force json binding: %+v %v", u, err)
+	}
+
+	// 先 GetRawData，之后可以多次绑定
+	req = httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(`{"name":"lee"}`))
+	c = newContext(httptest.NewRecorder(), req)
+	if _, err := c.GetRawData(); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		u = user{}
+		if err := c.ShouldBindWith(&u, JSONBinding{}); err != nil || u.Name != "lee" {
+			t.Fatalf("failed to bind the cached body: %+v %v", u, err)
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(`<user><name>aure</name><age>18</age></user>`))
+	u = user{}
+	if err := newContext(httptest.NewRecorder(), req).ShouldBindWith(&u, XMLBinding{}); err != nil || u.Name != "aure" || u.Age != 18 {
+		t.Fatalf("failed to bind xml: %+v %v", u, err)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/users?age=18", strings.NewReader("name=aure"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	u = user{}
+	if err := newContext(httptest.NewRecorder(), req).ShouldBindWith(&u, FormBinding{}); err != nil || u.Name != "aure" || u.Age != 18 {
+		t.Fatalf("failed to bind form: %+v %v", u, err)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/users?name=aure", failReader{t})
+	u = user{}
+	if err := newContext(httptest.NewRecorder(), req).ShouldBindWith(&u, QueryBinding{}); err != nil || u.Name != "aure" {
+		t.Fatalf("failed to bind query: %+v %v", u, err)
+	}
+}
+
+func TestShouldBindBodyWith(t *testing.T) {
+	type user struct {
+		Name string `json:"name" xml:"name"`
+	}
+	req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(`{"name":"aure"}`))
+	c := newContext(httptest.NewRecorder(), req)
+
+	// 先尝试 XML 失败，请求体被缓存，再用 JSON 绑定成功
+	var u user
+	if err := c.ShouldBindBodyWith(&u, XMLBinding{}); err == nil {
+		t.Fatalf("expect binding json as xml to fail, got %+v", u)
+	}
+	if err := c.ShouldBindBodyWith(&u, JSONBinding{}); err != nil || u.Name != "aure" {
+		t.Fatalf("failed to bind the cached body as json: %+v %v", u, err)
+	}
+}
@@ -1,9 +1,13 @@
 package gee
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"sync"
 )
 
 // alias for map[string]any for convenience
@@ -17,6 +21,8 @@ type Context struct {
 	Path   string
 	Method string
 	Params map[string]string
+	// pattern of the matched route, empty if no route matches
+	pattern string
 	// response info
 	StatusCode int
 	// middleware
@@ -24,6 +30,16 @@ type Context struct {
 	index    int
 	// for http render
 	engine *Engine
+	// cancel functions of contexts derived by DeriveContext
+	cancels []context.CancelFunc
+	// key/value pairs shared by middlewares and handlers of the request
+	mu   sync.RWMutex
+	Keys map[string]any
+	// data merged into the data of HTML, see AddTemplateData
+	templateData H
+	// request body cached by GetRawData
+	rawData []byte
+	rawRead bool
 }
 
 func newContext(w http.ResponseWriter, req *http.Request) *Context {
@@ -53,6 +69,75 @@ func (c *Context) Param(key string) string {
 	return c.Params[key]
 }
 
+// FullPath returns the registered pattern of the matched route, e.g. /assets/*filepath,
+// empty if no route matches. 适合日志、监控按路由而不是具体路径聚合
+func (c *Context) FullPath() string {
+	return c.pattern
+}
+
+// RequestContext returns the context of the request,
+// it is cancelled when the client's connection closes.
+func (c *Context) RequestContext() context.Context {
+	return c.Req.Context()
+}
+
+// Err returns the error of the request's context, it is non-nil once the client
+// has disconnected, so that a long-running handler can stop early.
+func (c *Context) Err() error {
+	return c.Req.Context().Err()
+}
+
+// DeriveContext 基于请求的 context 派生一个子 context，用于 handler 中开启的协程
+// 当整个处理链执行完成后，派生的 context 会被自动取消，防止协程泄漏
+func (c *Context) DeriveContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(c.Req.Context())
+	c.cancels = append(c.cancels, cancel)
+	return ctx, cancel
+}
+
+// cancelDerived cancels all contexts derived by DeriveContext
+func (c *Context) cancelDerived() {
+	for _, cancel := range c.cancels {
+		cancel()
+	}
+	c.cancels = nil
+}
+
+// Set 存储当前请求的键值对，用于在中间件和 handler 之间传递数据
+func (c *Context) Set(key string, value any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Keys == nil {
+		c.Keys = make(map[string]any)
+	}
+	c.Keys[key] = value
+}
+
+// Get returns the value for the given key set by Set
+func (c *Context) Get(key string) (value any, exists bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	value, exists = c.Keys[key]
+	return
+}
+
+// ContextSet is a typed wrapper of Context.Set
+func ContextSet[T any](c *Context, key string, v T) {
+	c.Set(key, v)
+}
+
+// ContextGet returns the value for key set by Set or ContextSet as a T,
+// ok is false if key doesn't exist or its value is not a T.
+// 避免在每个使用的地方重复写类型断言
+func ContextGet[T any](c *Context, key string) (v T, ok bool) {
+	value, exists := c.Get(key)
+	if !exists {
+		return v, false
+	}
+	v, ok = value.(T)
+	return v, ok
+}
+
 // response methods
 
 func (c *Context) Status(code int) {
@@ -70,10 +155,40 @@ func (c *Context) String(code int, format string, values ...any) {
 	c.Writer.Write(fmt.Appendf(nil, format, values...))
 }
 
+// JSONOptions 配置 Context.JSON 使用的 JSON 编码器
+// 零值与 encoding/json 的默认行为一致：转义 HTML 字符，不缩进
+type JSONOptions struct {
+	DisableHTMLEscape bool   // don't escape <, > and & in strings
+	Indent            string // indent of each level, empty means compact output
+}
+
 func (c *Context) JSON(code int, obj any) {
+	var opts JSONOptions
+	if c.engine != nil {
+		opts = c.engine.jsonOptions
+	}
+	c.writeJSON(code, obj, opts)
+}
+
+// IndentedJSON writes obj as pretty JSON indented with 4 spaces,
+// regardless of the options set by Engine.SetJSONEncoder.
+func (c *Context) IndentedJSON(code int, obj any) {
+	var opts JSONOptions
+	if c.engine != nil {
+		opts = c.engine.jsonOptions
+	}
+	opts.Indent = "    "
+	c.writeJSON(code, obj, opts)
+}
+
+func (c *Context) writeJSON(code int, obj any, opts JSONOptions) {
 	c.SetHeader("Content-Type", "application/json")
 	c.Status(code)
 	encoder := json.NewEncoder(c.Writer)
+	encoder.SetEscapeHTML(!opts.DisableHTMLEscape)
+	if opts.Indent != "" {
+		encoder.SetIndent("", opts.Indent)
+	}
 	if err := encoder.Encode(obj); err != nil {
 		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
 	}
@@ -84,10 +199,111 @@ func (c *Context) Data(code int, data []byte) {
 	c.Writer.Write(data)
 }
 
+// DataFromReader 将 reader 中的内容直接拷贝到响应中，避免将整个内容缓存在内存里
+// contentLength 小于 0 时不设置 Content-Length
+func (c *Context) DataFromReader(code int, contentLength int64, contentType string, reader io.Reader, extraHeaders map[string]string) {
+	for key, value := range extraHeaders {
+		c.SetHeader(key, value)
+	}
+	c.SetHeader("Content-Type", contentType)
+	if contentLength >= 0 {
+		c.SetHeader("Content-Length", strconv.FormatInt(contentLength, 10))
+	}
+	c.Status(code)
+	_, _ = io.Copy(c.Writer, reader)
+}
+
+// AddTemplateData 添加模板数据，HTML 渲染时会合并到传入的数据中
+// 用于中间件注入布局中共享的变量，例如当前用户、csrf token
+func (c *Context) AddTemplateData(key string, value any) {
+	if c.templateData == nil {
+		c.templateData = make(H)
+	}
+	c.templateData[key] = value
+}
+
+// mergeTemplateData merges the data added by AddTemplateData into data,
+// the values passed by the handler take precedence.
+// only nil, H and map[string]any can be merged, other data is returned as is.
+func (c *Context) mergeTemplateData(data any) any {
+	if len(c.templateData) == 0 {
+		return data
+	}
+	var m map[string]any
+	switch d := data.(type) {
+	case nil:
+	case H:
+		m = d
+	case map[string]any:
+		m = d
+	default:
+		return data
+	}
+	merged := make(H, len(c.templateData)+len(m))
+	for k, v := range c.templateData {
+		merged[k] = v
+	}
+	for k, v := range m {
+		merged[k] = v
+	}
+	return merged
+}
+
+// StreamJSONArray 将 items 中的元素逐个编码为 JSON 数组写入响应，不需要把整个结果集放在内存中
+// 每写入 streamFlushEvery 个元素刷新一次，items 关闭后写入 ] 结束
+// 响应头在开始时就已经发送，中途编码失败时返回错误并停止写入，此时客户端得到的是不完整的 JSON
+// 出错返回后剩余的元素在后台被丢弃，生产者不会阻塞在发送上，但仍需要在结束时关闭 items
+func (c *Context) StreamJSONArray(code int, items <-chan any) (err error) {
+	defer func() {
+		if err != nil {
+			go drain(items)
+		}
+	}()
+	c.SetHeader("Content-Type", "application/json")
+	c.Status(code)
+	flusher, _ := c.Writer.(http.Flusher)
+	if _, err := io.WriteString(c.Writer, "["); err != nil {
+		return err
+	}
+	n := 0
+	for item := range items {
+		data, err := json.Marshal(item)
+		if err != nil {
+			return fmt.Errorf("gee: encode item %d: %w", n, err)
+		}
+		if n > 0 {
+			data = append([]byte{','}, data...)
+		}
+		if _, err := c.Writer.Write(data); err != nil {
+			return err
+		}
+		n++
+		if flusher != nil && n%streamFlushEvery == 0 {
+			flusher.Flush()
+		}
+	}
+	if _, err := io.WriteString(c.Writer, "]\n"); err != nil {
+		return err
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// number of items written by StreamJSONArray between two flushes
+const streamFlushEvery = 16
+
+// drain discards the items until the channel is closed
+func drain(items <-chan any) {
+	for range items {
+	}
+}
+
 func (c *Context) HTML(code int, name string, data any) {
 	c.SetHeader("Content-Type", "text/html")
 	c.Status(code)
-	if err := c.engine.htmlTemplates.ExecuteTemplate(c.Writer, name, data); err != nil {
+	if err := c.engine.htmlTemplates.ExecuteTemplate(c.Writer, name, c.mergeTemplateData(data)); err != nil {
 		c.Fail(500, err.Error())
 	}
 }
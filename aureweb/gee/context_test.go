@@ -0,0 +1,190 @@
+package gee
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContextDataFromReader(t *testing.T) {
+	body := "id,name\n1,aure\n2,jack\n"
+	w := httptest.NewRecorder()
+	c := newContext(w, httptest.NewRequest(http.MethodGet, "/export", nil))
+	c.DataFromReader(http.StatusOK, int64(len(body)), "text/csv", strings.NewReader(body), map[string]string{
+		"Content-Disposition": `attachment; filename="export.csv"`,
+	})
+
+	if w.Code != http.StatusOK || w.Body.String() != body {
+		t.Fatalf("unexpected response %d %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Type") != "text/csv" {
+		t.Fatalf("wrong content type %q", w.Header().Get("Content-Type"))
+	}
+	if w.Header().Get("Content-Length") != strconv.Itoa(len(body)) {
+		t.Fatalf("wrong content length %q", w.Header().Get("Content-Length"))
+	}
+	if w.Header().Get("Content-Disposition") == "" {
+		t.Fatal("extra headers should be set")
+	}
+}
+
+func TestContextDeriveContext(t *testing.T) {
+	engine := New()
+	var derived context.Context
+	engine.GET("/", func(c *Context) {
+		derived, _ = c.DeriveContext()
+		if derived.Err() != nil {
+			t.Error("derived context should be alive while handling the request")
+		}
+		c.String(http.StatusOK, "ok")
+	})
+	engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if derived == nil || derived.Err() != context.Canceled {
+		t.Fatal("derived context should be cancelled once the request finishes")
+	}
+}
+
+func TestContextJSONEncoder(t *testing.T) {
+	engine := New()
+	engine.SetJSONEncoder(JSONOptions{DisableHTMLEscape: true})
+	engine.GET("/json", func(c *Context) {
+		c.JSON(http.StatusOK, H{"html": "<b>aure</b>"})
+	})
+	engine.GET("/indented", func(c *Context) {
+		c.IndentedJSON(http.StatusOK, H{"name": "aure"})
+	})
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/json", nil))
+	if body := w.Body.String(); body != "{\"html\":\"<b>aure</b>\"}\n" {
+		t.Fatalf("< should not be escaped, got %q", body)
+	}
+
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/indented", nil))
+	if body := w.Body.String(); body != "{\n    \"name\": \"aure\"\n}\n" {
+		t.Fatalf("expect indented output, got %q", body)
+	}
+
+	// 默认仍然转义 HTML
+	w = httptest.NewRecorder()
+	newContext(w, httptest.NewRequest(http.MethodGet, "/", nil)).JSON(http.StatusOK, H{"html": "<b>"})
+	if !strings.Contains(w.Body.String(), `\u003cb\u003e`) {
+		t.Fatalf("html should be escaped by default, got %q", w.Body.String())
+	}
+}
+
+func TestContextAddTemplateData(t *testing.T) {
+	engine := New()
+	engine.htmlTemplates = template.Must(template.New("hello.tmpl").Parse(`{{.user}}: {{.title}}`))
+	engine.Use(func(c *Context) {
+		c.AddTemplateData("user", "aure")
+		c.AddTemplateData("title", "default")
+		c.Next()
+	})
+	engine.GET("/", func(c *Context) {
+		c.HTML(http.StatusOK, "hello.tmpl", H{"title": "home"})
+	})
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if body := w.Body.String(); body != "aure: home" {
+		t.Fatalf("expect the user injected by middleware, got %q", body)
+	}
+}
+
+func TestContextStreamJSONArray(t *testing.T) {
+	items := make(chan any)
+	go func() {
+		defer close(items)
+		for i := range 100 {
+			items <- H{"id": i}
+		}
+	}()
+	w := httptest.NewRecorder()
+	if err := newContext(w, httptest.NewRequest(http.MethodGet, "/", nil)).StreamJSONArray(http.StatusOK, items); err != nil {
+		t.Fatal(err)
+	}
+	var got []struct{ ID int }
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || len(got) != 100 || got[99].ID != 99 {
+		t.Fatalf("expect a valid json array of 100 items, got %d items %v", len(got), err)
+	}
+	if !w.Flushed {
+		t.Fatal("the response should be flushed")
+	}
+
+	// 编码失败时返回错误，没有缓冲的生产者不会阻塞在之后的发送上
+	items = make(chan any)
+	produced := make(chan struct{})
+	go func() {
+		defer close(produced)
+		defer close(items)
+		items <- 1
+		items <- func() {}
+		for i := range 10 {
+			items <- i
+		}
+	}()
+	if err := newContext(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil)).StreamJSONArray(http.StatusOK, items); err == nil {
+		t.Fatal("expect an encode error")
+	}
+	select {
+	case <-produced:
+	case <-time.After(time.Second):
+		t.Fatal("the producer should not block after the encode error")
+	}
+}
+
+func TestContextGetTyped(t *testing.T) {
+	type user struct {
+		ID   int
+		Name string
+	}
+	c := newContext(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	ContextSet(c, "user", user{ID: 1, Name: "aure"})
+
+	u, ok := ContextGet[user](c, "user")
+	if !ok || u.ID != 1 || u.Name != "aure" {
+		t.Fatalf("failed to get the typed value: %+v %v", u, ok)
+	}
+	if _, ok := ContextGet[*user](c, "user"); ok {
+		t.Fatal("expect ok to be false for a value of another type")
+	}
+	if v, ok := ContextGet[string](c, "missing"); ok || v != "" {
+		t.Fatalf("expect the zero value for a missing key, got %q %v", v, ok)
+	}
+}
+
+func TestContextErr(t *testing.T) {
+	started, observed := make(chan struct{}), make(chan error, 1)
+	engine := New()
+	engine.GET("/slow", func(c *Context) {
+		close(started)
+		deadline := time.Now().Add(2 * time.Second)
+		for c.Err() == nil && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		observed <- c.Err()
+	})
+	ts := httptest.NewServer(engine)
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/slow", nil)
+	go func() {
+		<-started
+		cancel() // 客户端断开连接
+	}()
+	if _, err := http.DefaultClient.Do(req); err == nil {
+		t.Fatal("expect the request to be canceled")
+	}
+	if err := <-observed; err != context.Canceled {
+		t.Fatalf("expect the handler to observe context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package gee
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ErrInvalidSignature is returned when a signed cookie has been tampered with.
+var ErrInvalidSignature = errors.New("gee: invalid cookie signature")
+
+// SetCookie adds a Set-Cookie header to the response
+func (c *Context) SetCookie(cookie *http.Cookie) {
+	http.SetCookie(c.Writer, cookie)
+}
+
+// Cookie returns the value of the named cookie in the request
+func (c *Context) Cookie(name string) (string, error) {
+	cookie, err := c.Req.Cookie(name)
+	if err != nil {
+		return "", err
+	}
+	return cookie.Value, nil
+}
+
+// SetSignedCookie 设置一个带签名的 cookie，用于防篡改
+// cookie 的值为 base64(value).base64(HMAC-SHA256(name=value))
+// maxAge 的含义与 http.Cookie.MaxAge 相同
+func (c *Context) SetSignedCookie(name, value, secret string, maxAge int) {
+	c.SetCookie(&http.Cookie{
+		Name:     name,
+		Value:    signCookieValue(name, value, secret),
+		MaxAge:   maxAge,
+		Path:     "/",
+		HttpOnly: true,
+	})
+}
+
+// SignedCookie returns the value of a cookie set by SetSignedCookie,
+// ErrInvalidSignature is returned if the value or signature was modified.
+func (c *Context) SignedCookie(name, secret string) (string, error) {
+	raw, err := c.Cookie(name)
+	if err != nil {
+		return "", err
+	}
+	return verifyCookieValue(name, raw, secret)
+}
+
+func cookieMAC(name, value, secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(name + "=" + value))
+	return mac.Sum(nil)
+}
+
+func signCookieValue(name, value, secret string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(value)) + "." +
+		base64.RawURLEncoding.EncodeToString(cookieMAC(name, value, secret))
+}
+
+func verifyCookieValue(name, raw, secret string) (string, error) {
+	encoded, signature, ok := strings.Cut(raw, ".")
+	if !ok {
+		return "", ErrInvalidSignature
+	}
+	value, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", ErrInvalidSignature
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return "", ErrInvalidSignature
+	}
+	// hmac.Equal 使用常量时间比较，避免时序攻击
+	if !hmac.Equal(sum, cookieMAC(name, string(value), secret)) {
+		return "", ErrInvalidSignature
+	}
+	return string(value), nil
+}
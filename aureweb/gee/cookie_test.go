@@ -0,0 +1,46 @@
+package gee
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// signedCookieRequest returns a request carrying the cookies set on w
+func signedCookieRequest(w *httptest.ResponseRecorder) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, cookie := range w.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	return req
+}
+
+func TestSignedCookie(t *testing.T) {
+	const secret = "s3cr3t"
+	w := httptest.NewRecorder()
+	newContext(w, httptest.NewRequest(http.MethodGet, "/", nil)).SetSignedCookie("session", "user=aure; admin", secret, 3600)
+
+	req := signedCookieRequest(w)
+	value, err := newContext(httptest.NewRecorder(), req).SignedCookie("session", secret)
+	if err != nil || value != "user=aure; admin" {
+		t.Fatalf("expect the original value, got %q %v", value, err)
+	}
+
+	if _, err := newContext(httptest.NewRecorder(), req).SignedCookie("session", "other"); err != ErrInvalidSignature {
+		t.Fatalf("a wrong secret should fail verification, got %v", err)
+	}
+
+	// keep the original signature but replace the value
+	cookie, _ := req.Cookie("session")
+	_, signature, _ := strings.Cut(cookie.Value, ".")
+	tampered := httptest.NewRequest(http.MethodGet, "/", nil)
+	tampered.AddCookie(&http.Cookie{
+		Name:  "session",
+		Value: base64.RawURLEncoding.EncodeToString([]byte("user=root; admin")) + "." + signature,
+	})
+	if _, err := newContext(httptest.NewRecorder(), tampered).SignedCookie("session", secret); err != ErrInvalidSignature {
+		t.Fatalf("a tampered cookie should fail verification, got %v", err)
+	}
+}
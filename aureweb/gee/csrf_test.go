@@ -0,0 +1,58 @@
+package gee
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRF(t *testing.T) {
+	engine := New()
+	engine.Use(CSRF("s3cr3t"))
+	engine.GET("/form", func(c *Context) {
+		c.String(http.StatusOK, "%s", c.CSRFToken())
+	})
+	engine.POST("/form", func(c *Context) {
+		c.String(http.StatusOK, "ok")
+	})
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/form", nil))
+	token, cookies := w.Body.String(), w.Result().Cookies()
+	if token == "" || len(cookies) != 1 {
+		t.Fatalf("expect a token and a csrf cookie, got %q %v", token, cookies)
+	}
+
+	post := func(header, field string) int {
+		form := url.Values{}
+		if field != "" {
+			form.Set(CSRFField, field)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/form", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if header != "" {
+			req.Header.Set(CSRFHeader, header)
+		}
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := post(token, ""); code != http.StatusOK {
+		t.Fatalf("a valid header token should pass, got %d", code)
+	}
+	if code := post("", token); code != http.StatusOK {
+		t.Fatalf("a valid form token should pass, got %d", code)
+	}
+	if code := post("", ""); code != http.StatusForbidden {
+		t.Fatalf("a missing token should be rejected, got %d", code)
+	}
+	if code := post("invalid", ""); code != http.StatusForbidden {
+		t.Fatalf("an invalid token should be rejected, got %d", code)
+	}
+}
@@ -0,0 +1,61 @@
+package gee
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const (
+	flashCookieName = "gee_flash"
+	flashKey        = "gee/flashes"
+)
+
+// AddFlash 添加一条一次性的提示消息，常用于重定向之后展示，例如 "保存成功"
+// 消息保存在签名的 cookie 中，签名的密钥由 Engine.SetCookieSecret 设置，没有设置时 panic
+func (c *Context) AddFlash(msg string) {
+	secret := c.cookieSecret()
+	if secret == "" {
+		// 空密钥的签名任何人都可以伪造
+		panic("gee: AddFlash requires a cookie secret, call Engine.SetCookieSecret first")
+	}
+	flashes := append(c.pendingFlashes(), msg)
+	c.Set(flashKey, flashes)
+	data, _ := json.Marshal(flashes)
+	c.SetSignedCookie(flashCookieName, string(data), secret, 0)
+}
+
+// Flashes returns the flash messages and clears them,
+// so every message is read only once.
+func (c *Context) Flashes() []string {
+	flashes := c.pendingFlashes()
+	c.Set(flashKey, []string{})
+	if _, err := c.Req.Cookie(flashCookieName); err == nil {
+		c.SetCookie(&http.Cookie{Name: flashCookieName, Path: "/", MaxAge: -1})
+	}
+	return flashes
+}
+
+// pendingFlashes returns the messages not read yet,
+// the messages of the request cookie are loaded for the first time.
+func (c *Context) pendingFlashes() []string {
+	if flashes, ok := c.Get(flashKey); ok {
+		return flashes.([]string)
+	}
+	var flashes []string
+	// 没有密钥时不信任请求中的 cookie
+	if secret := c.cookieSecret(); secret != "" {
+		if data, err := c.SignedCookie(flashCookieName, secret); err == nil {
+			_ = json.Unmarshal([]byte(data), &flashes)
+		}
+	}
+	c.Set(flashKey, flashes)
+	return flashes
+}
+
+// cookieSecret returns the secret set by Engine.SetCookieSecret, empty if there is none
+func (c *Context) cookieSecret() string {
+	if c.engine == nil {
+		return ""
+	}
+	return c.engine.cookieSecret
+}
@@ -0,0 +1,83 @@
+package gee
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFlash(t *testing.T) {
+	engine := New()
+	engine.SetCookieSecret("s3cr3t")
+	engine.POST("/save", func(c *Context) {
+		c.AddFlash("saved")
+		c.AddFlash("welcome back")
+		c.SetHeader("Location", "/show")
+		c.Status(http.StatusFound)
+	})
+	engine.GET("/show", func(c *Context) {
+		c.String(http.StatusOK, "%s", strings.Join(c.Flashes(), ","))
+	})
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/save", nil))
+	cookies := w.Result().Cookies()
+	flash := cookies[len(cookies)-1] // the browser keeps the last one
+
+	// follow the redirect with the flash cookie
+	req := httptest.NewRequest(http.MethodGet, "/show", nil)
+	req.AddCookie(flash)
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	if w.Body.String() != "saved,welcome back" {
+		t.Fatalf("expect the flashes, got %q", w.Body.String())
+	}
+	cleared := w.Result().Cookies()
+	if len(cleared) != 1 || cleared[0].Name != flashCookieName || cleared[0].MaxAge >= 0 {
+		t.Fatalf("the flash cookie should be cleared, got %v", cleared)
+	}
+
+	// the flashes are read only once
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/show", nil))
+	if w.Body.String() != "" {
+		t.Fatalf("flashes should be cleared, got %q", w.Body.String())
+	}
+}
+
+func TestFlashWithoutSecret(t *testing.T) {
+	engine := New()
+	engine.GET("/save", func(c *Context) {
+		defer func() {
+			if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "SetCookieSecret") {
+				t.Errorf("expect AddFlash to panic without a cookie secret, got %v", r)
+			}
+		}()
+		c.AddFlash("saved")
+	})
+	engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/save", nil))
+
+	// 没有 engine 的 Context 同样 panic，而不是空指针
+	c := newContext(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	func() {
+		defer func() {
+			if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "SetCookieSecret") {
+				t.Errorf("expect AddFlash to panic without an engine, got %v", r)
+			}
+		}()
+		c.AddFlash("saved")
+	}()
+
+	// 空密钥签名的 cookie 不被读取
+	c = newContext(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	c.SetSignedCookie(flashCookieName, `["forged"]`, "", 0)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(c.Writer.(*httptest.ResponseRecorder).Result().Cookies()[0])
+	c = newContext(httptest.NewRecorder(), req)
+	c.engine = engine
+	if flashes := c.Flashes(); len(flashes) != 0 {
+		t.Fatalf("expect no flashes without a cookie secret, got %v", flashes)
+	}
+}
@@ -1,11 +1,15 @@
 package gee
 
 import (
+	"errors"
+	"fmt"
 	"html/template"
 	"log"
 	"net/http"
 	"path"
 	"strings"
+	"syscall"
+	"time"
 )
 
 // 定义了类型 HandlerFunc，这是提供给框架用户的，用来定义路由映射的处理方法
@@ -25,11 +29,17 @@ type Engine struct {
 	// for http render
 	htmlTemplates *template.Template
 	funcMap       template.FuncMap
+	// secret used to sign the cookies set by the framework, e.g. flash messages
+	cookieSecret string
+	// options of the encoder used by Context.JSON
+	jsonOptions JSONOptions
 }
 
 type RouterGroup struct {
 	prefix      string
 	middlewares []HandlerFunc
+	// 只在匹配到路由后才执行的中间件，404 等未匹配的请求不会执行
+	matchedMiddlewares []HandlerFunc
 	// 设计模式：回指 Back-Reference
 	// 通过在 RouterGroup 中嵌入 Engine 的指针，任何一个 RouterGroup 都可以访问整个引擎的全局配置
 	engine *Engine
@@ -72,7 +82,11 @@ func (group *RouterGroup) Group(prefix string) *RouterGroup {
 func (group *RouterGroup) addRoute(method string, comp string, handler HandlerFunc) {
 	pattern := group.prefix + comp
 	log.Printf("Route %4s - %s", method, pattern)
-	group.engine.router.addRoute(method, pattern, handler)
+	// 与 http.ServeMux 一样，注册非法的路由直接 panic，在启动时就能发现问题
+	if err := group.engine.router.addRoute(method, pattern, handler); err != nil {
+		panic(err)
+	}
+	group.engine.buildChain(method + "-" + pattern)
 }
 
 func (group *RouterGroup) GET(pattern string, handler HandlerFunc) {
@@ -86,6 +100,20 @@ func (group *RouterGroup) POST(pattern string, handler HandlerFunc) {
 // Use 注册中间件
 func (group *RouterGroup) Use(middlewares ...HandlerFunc) {
 	group.middlewares = append(group.middlewares, middlewares...)
+	// 中间件变化后，已注册路由的处理链都需要重新计算
+	for key := range group.engine.router.handlers {
+		group.engine.buildChain(key)
+	}
+}
+
+// UseMatched registers middlewares that run only for requests matching a route of the group,
+// unlike Use they are skipped for unmatched requests, e.g. a 404 under the group prefix.
+// They run after the middlewares registered by Use of the same group.
+func (group *RouterGroup) UseMatched(middlewares ...HandlerFunc) {
+	group.matchedMiddlewares = append(group.matchedMiddlewares, middlewares...)
+	for key := range group.engine.router.handlers {
+		group.engine.buildChain(key)
+	}
 }
 
 func (group *RouterGroup) createStaticHandler(relativePath string, fs http.FileSystem) HandlerFunc {
@@ -97,10 +125,13 @@ func (group *RouterGroup) createStaticHandler(relativePath string, fs http.FileS
 	fileServer := http.StripPrefix(absolutePath, http.FileServer(fs))
 	return func(c *Context) {
 		file := c.Param("filepath")
-		if _, err := fs.Open(file); err != nil {
+		// 只检查文件是否存在，读取（包括 Range 请求）交给 http.FileServer，检查后及时关闭文件
+		f, err := fs.Open(file)
+		if err != nil {
 			c.Status(http.StatusNotFound)
 			return
 		}
+		_ = f.Close()
 		fileServer.ServeHTTP(c.Writer, c.Req)
 	}
 }
@@ -116,6 +147,16 @@ func (engine *Engine) SetFuncMap(funcMap template.FuncMap) {
 	engine.funcMap = funcMap
 }
 
+// SetJSONEncoder sets the options of the encoder used by Context.JSON
+func (engine *Engine) SetJSONEncoder(opts JSONOptions) {
+	engine.jsonOptions = opts
+}
+
+// SetCookieSecret sets the secret used to sign the cookies set by the framework
+func (engine *Engine) SetCookieSecret(secret string) {
+	engine.cookieSecret = secret
+}
+
 func (engine *Engine) LoadHTMLGlob(pattern string) {
 	// template.New("") 创建一个新的、名字为空的模板，这个对象是所有模板的根节点
 	// (*Template).Funcs() 给模板引擎注册一个自定义的模板函数，里面可以存放自定义的Go函数，这些函数可以在模板文件中直接调用
@@ -125,22 +166,107 @@ func (engine *Engine) LoadHTMLGlob(pattern string) {
 	engine.htmlTemplates = template.Must(template.New("").Funcs(engine.funcMap).ParseGlob(pattern))
 }
 
+// RenderToString renders the loaded template name with data and returns the output,
+// e.g. for the body of an email, nothing is written to any response.
+func (engine *Engine) RenderToString(name string, data any) (string, error) {
+	if engine.htmlTemplates == nil {
+		return "", errors.New("gee: no template is loaded, call LoadHTMLGlob first")
+	}
+	var buf strings.Builder
+	if err := engine.htmlTemplates.ExecuteTemplate(&buf, name, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Errors returned by Run, use errors.Is to check them, the original error is wrapped as well
+var (
+	ErrAddrInUse        = errors.New("gee: address already in use")
+	ErrPermissionDenied = errors.New("gee: permission denied")
+)
+
 func (engine *Engine) Run(addr string) (err error) {
-	return http.ListenAndServe(addr, engine)
+	return wrapListenError(http.ListenAndServe(addr, engine))
 }
 
-// w & req 是标准库中 HTTP 服务器在接收到请求时自动创建并传入的
-func (engine *Engine) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+// RunWithRetry is like Run, but restarts the server up to attempts times in total when it fails,
+// e.g. the address isn't released yet at boot, the wait between attempts starts at backoff
+// and doubles each time. The error of the last attempt is returned.
+func (engine *Engine) RunWithRetry(addr string, attempts int, backoff time.Duration) (err error) {
+	for attempt := 1; ; attempt++ {
+		err = engine.Run(addr)
+		// 服务被主动关闭时不再重启
+		if errors.Is(err, http.ErrServerClosed) || attempt >= attempts {
+			return err
+		}
+		log.Printf("gee: run on %s failed, retry after %s (%d/%d): %v\n", addr, backoff, attempt, attempts, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// wrapListenError 将常见的监听错误包装为 ErrAddrInUse、ErrPermissionDenied，便于调用方处理（例如换一个端口）
+func wrapListenError(err error) error {
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		return fmt.Errorf("%w: %w", ErrAddrInUse, err)
+	case errors.Is(err, syscall.EACCES):
+		return fmt.Errorf("%w: %w", ErrPermissionDenied, err)
+	default:
+		return err
+	}
+}
+
+// groupMiddlewares returns the middlewares of all groups that path belongs to,
+// the ones registered by UseMatched are included only if matched is true
+func (engine *Engine) groupMiddlewares(path string, matched bool) []HandlerFunc {
 	var middlewares []HandlerFunc
 	for _, group := range engine.groups {
-		if strings.HasPrefix(req.URL.Path, group.prefix) { // 如果请求路径有前缀，则添加中间件
+		if strings.HasPrefix(path, group.prefix) { // 如果请求路径有前缀，则添加中间件
 			middlewares = append(middlewares, group.middlewares...)
+			if matched {
+				middlewares = append(middlewares, group.matchedMiddlewares...)
+			}
+		}
+	}
+	return middlewares
+}
+
+// buildChain 计算路由 key (method-pattern) 的处理链：所属分组的中间件 + handler
+// 分组按请求路径匹配，pattern 中的参数可能匹配分组前缀时（例如分组 /v1 和路由 /:version/x），
+// 处理链取决于请求路径，不缓存，由 router.handle 在每次请求时计算
+func (engine *Engine) buildChain(key string) {
+	_, pattern, _ := strings.Cut(key, "-")
+	if engine.chainDependsOnPath(pattern) {
+		delete(engine.router.chains, key)
+		return
+	}
+	chain := append(engine.groupMiddlewares(pattern, true), engine.router.handlers[key])
+	// 限制容量，处理链被所有请求共享，避免 append 修改共享的底层数组
+	engine.router.chains[key] = chain[:len(chain):len(chain)]
+}
+
+// chainDependsOnPath reports whether the groups a request of pattern belongs to can't be
+// told from pattern, i.e. a group prefix reaches into the first wildcard segment of pattern.
+func (engine *Engine) chainDependsOnPath(pattern string) bool {
+	i := strings.IndexAny(pattern, ":*")
+	if i < 0 {
+		return false
+	}
+	for _, group := range engine.groups {
+		if len(group.prefix) > i {
+			return true
 		}
 	}
+	return false
+}
+
+// w & req 是标准库中 HTTP 服务器在接收到请求时自动创建并传入的
+func (engine *Engine) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	c := newContext(w, req)
-	c.handlers = middlewares
 	// day6 template
 	c.engine = engine
+	defer c.cancelDerived()
 	engine.router.handle(c)
 }
 
@@ -0,0 +1,209 @@
+package gee
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newManyGroupsEngine returns an engine with n groups, each group has
+// a middleware and a route
+func newManyGroupsEngine(n int) *Engine {
+	engine := New()
+	engine.Use(func(c *Context) { c.Next() })
+	for i := range n {
+		group := engine.Group(fmt.Sprintf("/group%d", i))
+		group.Use(func(c *Context) { c.Next() })
+		group.GET("/hello/:name", func(c *Context) {
+			c.Status(http.StatusOK)
+		})
+	}
+	return engine
+}
+
+func BenchmarkServeHTTPManyGroups(b *testing.B) {
+	engine := newManyGroupsEngine(100)
+	req := httptest.NewRequest(http.MethodGet, "/group50/hello/aure", nil)
+	w := httptest.NewRecorder()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		engine.ServeHTTP(w, req)
+	}
+}
+
+func TestMiddlewareChains(t *testing.T) {
+	engine := New()
+	v1 := engine.Group("/v1")
+	v1.GET("/hello", func(c *Context) {
+		c.String(http.StatusOK, "hello")
+	})
+	// 中间件在路由之后注册，也要作用于已注册的路由
+	v1.Use(func(c *Context) {
+		c.SetHeader("X-Group", "v1")
+		c.Next()
+	})
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/hello", nil))
+	if w.Header().Get("X-Group") != "v1" || w.Body.String() != "hello" {
+		t.Fatalf("middleware added after the route should run, got %q %q", w.Header().Get("X-Group"), w.Body.String())
+	}
+
+	// 未匹配到路由时，分组中间件同样执行
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/missing", nil))
+	if w.Code != http.StatusNotFound || w.Header().Get("X-Group") != "v1" {
+		t.Fatalf("expect 404 with group middleware, got %d %q", w.Code, w.Header().Get("X-Group"))
+	}
+}
+
+func TestMiddlewareChainsWildcardPrefix(t *testing.T) {
+	engine := New()
+	v1 := engine.Group("/v1")
+	v1.Use(func(c *Context) {
+		c.SetHeader("X-Group", "v1")
+		c.Next()
+	})
+	// 参数段可能匹配分组前缀，分组按请求路径决定
+	engine.GET("/:version/x", func(c *Context) {
+		c.String(http.StatusOK, "%s", c.Param("version"))
+	})
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/x", nil))
+	if w.Body.String() != "v1" || w.Header().Get("X-Group") != "v1" {
+		t.Fatalf("expect the /v1 middleware for /v1/x, got %q %q", w.Body.String(), w.Header().Get("X-Group"))
+	}
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v2/x", nil))
+	if w.Body.String() != "v2" || w.Header().Get("X-Group") != "" {
+		t.Fatalf("expect no /v1 middleware for /v2/x, got %q %q", w.Body.String(), w.Header().Get("X-Group"))
+	}
+}
+
+func TestUseMatched(t *testing.T) {
+	engine := New()
+	v1 := engine.Group("/v1")
+	var matched int
+	v1.UseMatched(func(c *Context) {
+		matched++
+		c.Next()
+	})
+	v1.GET("/hello", func(c *Context) {
+		c.String(http.StatusOK, "hello")
+	})
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/hello", nil))
+	if w.Code != http.StatusOK || matched != 1 {
+		t.Fatalf("expect matched middleware to run once, got %d runs, status %d", matched, w.Code)
+	}
+
+	// 未匹配到路由时不执行
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/missing", nil))
+	if w.Code != http.StatusNotFound || matched != 1 {
+		t.Fatalf("expect 404 without matched middleware, got %d runs, status %d", matched, w.Code)
+	}
+}
+
+func TestStaticRange(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte("0123456789"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	engine := New()
+	engine.Static("/assets", dir)
+
+	req := httptest.NewRequest(http.MethodGet, "/assets/file.txt", nil)
+	req.Header.Set("Range", "bytes=2-5")
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	if w.Code != http.StatusPartialContent || w.Body.String() != "2345" {
+		t.Fatalf("expect 206 with bytes 2-5, got %d %q", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Range"); got != "bytes 2-5/10" {
+		t.Fatalf("wrong Content-Range %q", got)
+	}
+
+	// If-Range 与文件不匹配时返回完整内容
+	req = httptest.NewRequest(http.MethodGet, "/assets/file.txt", nil)
+	req.Header.Set("Range", "bytes=2-5")
+	req.Header.Set("If-Range", `"stale-etag"`)
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+		t.Fatalf("expect the full file for a stale If-Range, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestRunAddrInUse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+
+	err = New().Run(l.Addr().String())
+	if !errors.Is(err, ErrAddrInUse) {
+		t.Fatalf("expect ErrAddrInUse, got %v", err)
+	}
+}
+
+func TestRunWithRetry(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	engine := New()
+	engine.GET("/ping", func(c *Context) { c.String(http.StatusOK, "pong") })
+	done := make(chan error, 1)
+	go func() { done <- engine.RunWithRetry(addr, 5, 100*time.Millisecond) }()
+
+	// 第一次启动时端口被占用，端口释放后重试成功
+	time.Sleep(50 * time.Millisecond)
+	_ = l.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if resp, err := http.Get("http://" + addr + "/ping"); err == nil {
+			_ = resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return
+			}
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("RunWithRetry should not give up: %v", err)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	t.Fatal("the server should run once the port is released")
+}
+
+func TestRenderToString(t *testing.T) {
+	engine := New()
+	if _, err := engine.RenderToString("email.tmpl", nil); err == nil {
+		t.Fatal("expect an error without loaded templates")
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "email.tmpl"), []byte(`Hello {{.Name}}, <b>welcome</b>`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	engine.LoadHTMLGlob(filepath.Join(dir, "*.tmpl"))
+	got, err := engine.RenderToString("email.tmpl", map[string]string{"Name": "<aure>"})
+	if err != nil || got != "Hello &lt;aure&gt;, <b>welcome</b>" {
+		t.Fatalf("unexpected output %q %v", got, err)
+	}
+	if _, err := engine.RenderToString("missing.tmpl", nil); err == nil {
+		t.Fatal("expect an error for a missing template")
+	}
+}
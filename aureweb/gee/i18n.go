@@ -0,0 +1,91 @@
+package gee
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const i18nKey = "gee/i18n"
+
+// i18n is the translation state of a request, stored by the I18n middleware
+type i18n struct {
+	bundle   map[string]string // bundle of the selected language
+	fallback map[string]string // bundle of the default language
+}
+
+// I18n 根据 Accept-Language 选择语言包，之后可以通过 Context.T 翻译
+// bundles 的 key 是语言（例如 en、fr、zh-CN），value 是该语言的翻译
+// defaultLang 默认为 en，用于没有匹配语言以及选中的语言包缺少某个 key 时
+func I18n(bundles map[string]map[string]string, defaultLang ...string) HandlerFunc {
+	def := "en"
+	if len(defaultLang) > 0 {
+		def = defaultLang[0]
+	}
+	return func(c *Context) {
+		lang := matchLanguage(c.Req.Header.Get("Accept-Language"), bundles)
+		if lang == "" {
+			lang = def
+		}
+		c.Set(i18nKey, &i18n{bundle: bundles[lang], fallback: bundles[def]})
+		c.Next()
+	}
+}
+
+// T returns the translation of key in the language selected by the I18n middleware,
+// the translation of the default language is used if it is missing,
+// key itself is returned if neither has it.
+func (c *Context) T(key string) string {
+	v, _ := c.Get(i18nKey)
+	if t, ok := v.(*i18n); ok {
+		if msg, ok := t.bundle[key]; ok {
+			return msg
+		}
+		if msg, ok := t.fallback[key]; ok {
+			return msg
+		}
+	}
+	return key
+}
+
+// matchLanguage returns the language of bundles most preferred by header,
+// e.g. "fr-CH, fr;q=0.9, en;q=0.8", fr-CH falls back to fr if there is no fr-CH bundle.
+func matchLanguage(header string, bundles map[string]map[string]string) string {
+	type language struct {
+		tag string
+		q   float64
+	}
+	var langs []language
+	for _, item := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		langs = append(langs, language{tag: tag, q: q})
+	}
+	// 按权重从高到低排序，权重相同时保持出现的顺序
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+	for _, lang := range langs {
+		if lang.q <= 0 {
+			continue
+		}
+		for bundleLang := range bundles {
+			if strings.EqualFold(bundleLang, lang.tag) {
+				return bundleLang
+			}
+		}
+		base, _, _ := strings.Cut(lang.tag, "-")
+		for bundleLang := range bundles {
+			if strings.EqualFold(bundleLang, base) {
+				return bundleLang
+			}
+		}
+	}
+	return ""
+}
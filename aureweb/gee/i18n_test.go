@@ -0,0 +1,42 @@
+package gee
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestI18n(t *testing.T) {
+	engine := New()
+	engine.Use(I18n(map[string]map[string]string{
+		"en": {"hello": "Hello", "bye": "Goodbye"},
+		"fr": {"hello": "Bonjour"},
+	}))
+	engine.GET("/:key", func(c *Context) {
+		c.String(http.StatusOK, "%s", c.T(c.Param("key")))
+	})
+
+	translate := func(lang, key string) string {
+		req := httptest.NewRequest(http.MethodGet, "/"+key, nil)
+		req.Header.Set("Accept-Language", lang)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	if got := translate("fr", "hello"); got != "Bonjour" {
+		t.Fatalf("expect the french translation, got %q", got)
+	}
+	if got := translate("fr-CH, en;q=0.8", "hello"); got != "Bonjour" {
+		t.Fatalf("fr-CH should fall back to fr, got %q", got)
+	}
+	if got := translate("fr", "bye"); got != "Goodbye" {
+		t.Fatalf("a missing key should fall back to the default language, got %q", got)
+	}
+	if got := translate("de", "hello"); got != "Hello" {
+		t.Fatalf("an unknown language should use the default language, got %q", got)
+	}
+	if got := translate("fr", "missing"); got != "missing" {
+		t.Fatalf("an unknown key should be returned as is, got %q", got)
+	}
+}
@@ -11,7 +11,17 @@ func Logger() HandlerFunc {
 		t := time.Now()
 		// 处理请求
 		c.Next()
-		// 记录结束时间
-		log.Printf("[%d] %s in %v", c.StatusCode, c.Req.RequestURI, time.Since(t))
+		// 记录结束时间，按路由的 pattern 标记请求，/user/1 和 /user/2 都归到 /user/:id
+		log.Printf("[%d] %s %s (route %s) in %v", c.StatusCode, c.Method, c.Req.RequestURI, routeLabel(c), time.Since(t))
 	}
 }
+
+// routeLabel returns the label of the request for logs and metrics, it is the pattern of
+// the matched route, so that the number of labels doesn't grow with the concrete paths.
+// 未匹配到路由的请求统一标记为 "-"
+func routeLabel(c *Context) string {
+	if p := c.FullPath(); p != "" {
+		return p
+	}
+	return "-"
+}
@@ -0,0 +1,37 @@
+package gee
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLoggerRouteLabel(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	engine := New()
+	engine.Use(Logger())
+	engine.GET("/user/:id", func(c *Context) {
+		c.String(http.StatusOK, "%s", c.Param("id"))
+	})
+	for _, path := range []string{"/user/1", "/user/2"} {
+		buf.Reset()
+		engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		if !strings.Contains(buf.String(), "(route /user/:id)") {
+			t.Fatalf("expect the route label /user/:id for %s, got %q", path, buf.String())
+		}
+	}
+
+	// 未匹配到路由时不使用具体路径作为标签
+	buf.Reset()
+	engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/missing/42", nil))
+	if !strings.Contains(buf.String(), "(route -)") {
+		t.Fatalf("expect the route label - for a 404, got %q", buf.String())
+	}
+}
@@ -0,0 +1,109 @@
+package gee
+
+import (
+	"encoding/xml"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MIME types supported by Negotiate
+const (
+	MIMEJSON    = "application/json"
+	MIMEXML     = "application/xml"
+	MIMEHTML    = "text/html"
+	MIMEPlain   = "text/plain"
+	MIMEMsgPack = "application/x-msgpack"
+)
+
+// Negotiate 内容协商的参数，Offered 是服务端可以提供的格式，按优先级排列
+// 各格式的数据为空时使用 Data
+type Negotiate struct {
+	Offered  []string
+	HTMLName string // template name for MIMEHTML
+	HTMLData any
+	JSONData any
+	XMLData  any
+	Data     any
+}
+
+// XML writes obj as XML
+func (c *Context) XML(code int, obj any) {
+	c.SetHeader("Content-Type", MIMEXML)
+	c.Status(code)
+	if err := xml.NewEncoder(c.Writer).Encode(obj); err != nil {
+		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// MsgPack writes obj in the binary MessagePack format
+func (c *Context) MsgPack(code int, obj any) {
+	c.SetHeader("Content-Type", MIMEMsgPack)
+	c.Status(code)
+	if err := msgpack.NewEncoder(c.Writer).Encode(obj); err != nil {
+		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// NegotiateFormat returns the first offered MIME type accepted by the client,
+// the first offered one is returned if the request has no Accept header,
+// and "" if none of them is accepted.
+//
+// 为了简单，不处理 q 权重，按 Accept 中出现的顺序匹配，支持 */* 和 type/* 通配
+func (c *Context) NegotiateFormat(offered ...string) string {
+	if len(offered) == 0 {
+		return ""
+	}
+	accept := c.Req.Header.Get("Accept")
+	if accept == "" {
+		return offered[0]
+	}
+	for _, item := range strings.Split(accept, ",") {
+		accepted, _, err := mime.ParseMediaType(strings.TrimSpace(item))
+		if err != nil {
+			continue
+		}
+		for _, offer := range offered {
+			if acceptMatch(accepted, offer) {
+				return offer
+			}
+		}
+	}
+	return ""
+}
+
+func acceptMatch(accepted, offer string) bool {
+	if accepted == "*/*" || accepted == offer {
+		return true
+	}
+	prefix, ok := strings.CutSuffix(accepted, "/*")
+	return ok && strings.HasPrefix(offer, prefix+"/")
+}
+
+// Negotiate writes the response in the format chosen by NegotiateFormat,
+// 406 Not Acceptable is returned if the client accepts none of the offered formats.
+func (c *Context) Negotiate(code int, config Negotiate) {
+	switch c.NegotiateFormat(config.Offered...) {
+	case MIMEJSON:
+		c.JSON(code, orData(config.JSONData, config.Data))
+	case MIMEXML:
+		c.XML(code, orData(config.XMLData, config.Data))
+	case MIMEHTML:
+		c.HTML(code, config.HTMLName, orData(config.HTMLData, config.Data))
+	case MIMEPlain:
+		c.String(code, "%v", config.Data)
+	case MIMEMsgPack:
+		c.MsgPack(code, config.Data)
+	default:
+		c.Fail(http.StatusNotAcceptable, "the accepted formats are not offered by the server")
+	}
+}
+
+func orData(data, fallback any) any {
+	if data != nil {
+		return data
+	}
+	return fallback
+}
@@ -0,0 +1,43 @@
+package gee
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestNegotiate(t *testing.T) {
+	type user struct {
+		Name string
+		Age  int
+	}
+	u := user{Name: "aure", Age: 18}
+	negotiate := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		newContext(w, req).Negotiate(http.StatusOK, Negotiate{
+			Offered: []string{MIMEJSON, MIMEMsgPack},
+			Data:    u,
+		})
+		return w
+	}
+
+	w := negotiate(MIMEMsgPack)
+	if w.Header().Get("Content-Type") != MIMEMsgPack {
+		t.Fatalf("expect a msgpack response, got %q", w.Header().Get("Content-Type"))
+	}
+	var got user
+	if err := msgpack.Unmarshal(w.Body.Bytes(), &got); err != nil || got != u {
+		t.Fatalf("failed to decode the msgpack body: %+v %v", got, err)
+	}
+
+	if w := negotiate("text/html, application/*;q=0.9"); w.Header().Get("Content-Type") != MIMEJSON {
+		t.Fatalf("expect application/* to match json first, got %q", w.Header().Get("Content-Type"))
+	}
+	if w := negotiate("text/html"); w.Code != http.StatusNotAcceptable {
+		t.Fatalf("expect 406 for an unoffered format, got %d", w.Code)
+	}
+}
@@ -0,0 +1,50 @@
+package gee
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// ReverseProxy forwards the request to target and streams the response back.
+// 匹配的路由中第一个 : 或 * 之前的静态前缀会被去掉，剩余的路径拼接在 target 的路径之后
+// 例如路由 /api/*path 代理到 http://backend/v1 时，/api/users/1 被转发到 http://backend/v1/users/1
+func (c *Context) ReverseProxy(target *url.URL) {
+	// 请求体已经被 GetRawData 读取过时，转发缓存的内容
+	if c.rawRead && c.rawData != nil {
+		c.Req.Body = io.NopCloser(bytes.NewReader(c.rawData))
+	}
+	prefix := routePrefix(c.pattern)
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			path := strings.TrimPrefix(r.In.URL.Path, prefix)
+			if !strings.HasPrefix(path, "/") {
+				path = "/" + path
+			}
+			r.Out.URL.Path, r.Out.URL.RawPath = path, ""
+			r.SetURL(target)
+			r.SetXForwarded()
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			c.StatusCode = resp.StatusCode
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("gee: proxy %s to %s: %v", r.URL.Path, target, err)
+			c.Status(http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(c.Writer, c.Req)
+}
+
+// routePrefix returns the static part of pattern before its first wildcard segment
+func routePrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, ":*"); i >= 0 {
+		pattern = pattern[:i]
+	}
+	return strings.TrimSuffix(pattern, "/")
+}
@@ -0,0 +1,63 @@
+package gee
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestReverseProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Backend", "yes")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s %s?%s %s %s", r.Method, r.URL.Path, r.URL.RawQuery, r.Header.Get("X-Test"), body)
+	}))
+	defer backend.Close()
+	target, _ := url.Parse(backend.URL + "/v1")
+
+	r := New()
+	var status int
+	r.Use(func(c *Context) {
+		c.Next()
+		status = c.StatusCode
+	})
+	r.POST("/api/*path", func(c *Context) {
+		c.ReverseProxy(target)
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/api/users/1?page=2", strings.NewReader("hello"))
+	req.Header.Set("X-Test", "header")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated || status != http.StatusCreated {
+		t.Fatalf("expect status 201 to be relayed, got %d %d", w.Code, status)
+	}
+	if w.Header().Get("X-Backend") != "yes" {
+		t.Fatal("expect the headers of the backend to be relayed")
+	}
+	if want := "POST /v1/users/1?page=2 header hello"; w.Body.String() != want {
+		t.Fatalf("expect %q, got %q", want, w.Body.String())
+	}
+}
+
+func TestReverseProxyBadGateway(t *testing.T) {
+	backend := httptest.NewServer(http.NotFoundHandler())
+	target, _ := url.Parse(backend.URL)
+	backend.Close()
+
+	r := New()
+	r.GET("/api/*path", func(c *Context) {
+		c.ReverseProxy(target)
+	})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/users", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("expect 502 when the backend is down, got %d", w.Code)
+	}
+}
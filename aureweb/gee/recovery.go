@@ -30,10 +30,26 @@ func trace(message string) string {
 	return str.String()
 }
 
+// HTTPError 可以带着状态码 panic 的错误，Recovery 会以该状态码响应，而不是 500
+// 例如 panic(ErrNotFound)，ErrNotFound 的 StatusCode 返回 404
+type HTTPError interface {
+	StatusCode() int
+}
+
 func Recovery() HandlerFunc {
 	return func(c *Context) {
 		defer func() {
 			if err := recover(); err != nil {
+				if httpErr, ok := err.(HTTPError); ok {
+					code := httpErr.StatusCode()
+					message := http.StatusText(code)
+					if e, ok := err.(error); ok {
+						message = e.Error()
+					}
+					log.Printf("[Recovery] panic with status %d: %s\n", code, message)
+					c.Fail(code, message)
+					return
+				}
 				message := fmt.Sprintf("%s", err)
 				log.Printf("[Recovery] panic recovered:\n%s\n", trace(message))
 				c.Fail(http.StatusInternalServerError, "Internal Server Error")
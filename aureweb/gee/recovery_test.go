@@ -0,0 +1,35 @@
+package gee
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type notFoundError struct{}
+
+func (notFoundError) Error() string   { return "user not found" }
+func (notFoundError) StatusCode() int { return http.StatusNotFound }
+
+func TestRecoveryHTTPError(t *testing.T) {
+	engine := New()
+	engine.Use(Recovery())
+	engine.GET("/user", func(c *Context) {
+		panic(notFoundError{})
+	})
+	engine.GET("/panic", func(c *Context) {
+		panic("something went wrong")
+	})
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/user", nil))
+	if w.Code != http.StatusNotFound || w.Body.String() != "{\"message\":\"user not found\"}\n" {
+		t.Fatalf("expect 404 from the HTTPError, got %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/panic", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expect 500 from a plain panic, got %d", w.Code)
+	}
+}
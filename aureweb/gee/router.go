@@ -1,13 +1,18 @@
 package gee
 
 import (
+	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 )
 
 type router struct {
 	roots    map[string]*node
 	handlers map[string]HandlerFunc
+	// chains key 是 method-pattern，value 是该路由完整的处理链（中间件 + handler）
+	// 在注册路由和中间件时预先计算，处理请求时无需再遍历所有分组
+	chains map[string][]HandlerFunc
 }
 
 // 初始化路由，创建roots和handlers的map
@@ -21,6 +26,7 @@ func newRouter() *router {
 	return &router{
 		roots:    make(map[string]*node),
 		handlers: make(map[string]HandlerFunc),
+		chains:   make(map[string][]HandlerFunc),
 	}
 }
 
@@ -45,11 +51,46 @@ func parsePattern(pattern string) []string {
 	return parts
 }
 
-func (r *router) addRoute(method string, pattern string, handler HandlerFunc) {
+// 解析请求路径，返回每一段 URL 解码后的值
+//
+// path 需要是未解码的路径（URL.EscapedPath），这样编码后的 / (%2F) 不会被当作分隔符
+// 例如，/hello/a%2Fb 解析为 ["hello", "a/b"]，/hello/a%20b 解析为 ["hello", "a b"]
+func parsePath(path string) []string {
+	vs := strings.Split(path, "/")
+	parts := make([]string, 0, len(vs))
+	for _, item := range vs {
+		if item == "" {
+			continue
+		}
+		if unescaped, err := url.PathUnescape(item); err == nil {
+			item = unescaped
+		}
+		parts = append(parts, item)
+	}
+	return parts
+}
+
+// validatePattern 检查 pattern 是否合法
+// parsePattern 遇到 * 就停止解析，所以 * 必须是最后一段，否则后面的部分会被悄悄丢弃
+// 例如 /a/*rest/b 会被当作 /a/*rest
+func validatePattern(pattern string) error {
+	segments := strings.Split(strings.Trim(pattern, "/"), "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, "*") && i != len(segments)-1 {
+			return fmt.Errorf("gee: catch-all %q must be the last segment in pattern %q", segment, pattern)
+		}
+	}
+	return nil
+}
+
+func (r *router) addRoute(method string, pattern string, handler HandlerFunc) error {
 	// log.Printf("Route %4s - %s", method, pattern)
 	// key := method + "-" + pattern
 	// r.handlers[key] = handler
 
+	if err := validatePattern(pattern); err != nil {
+		return err
+	}
 	parts := parsePattern(pattern)
 	// 如果method对应的trie树不存在，则新建一个
 	_, ok := r.roots[method]
@@ -59,11 +100,13 @@ func (r *router) addRoute(method string, pattern string, handler HandlerFunc) {
 	r.roots[method].insert(pattern, parts, 0)
 	key := method + "-" + pattern
 	r.handlers[key] = handler
+	return nil
 }
 
+// path 是未解码的请求路径，参数的值会被 URL 解码
 func (r *router) getRoute(method string, path string) (*node, map[string]string) {
 	// searchParts 包含的是用户请求的实际的路径值，不包含*和:
-	searchParts := parsePattern(path)
+	searchParts := parsePath(path)
 	root, ok := r.roots[method]
 	if !ok {
 		return nil, nil
@@ -91,14 +134,20 @@ func (r *router) getRoute(method string, path string) (*node, map[string]string)
 
 func (r *router) handle(c *Context) {
 	// 如果当前请求的路由在路由表中，则执行对应的handler
-	node, params := r.getRoute(c.Method, c.Path)
+	node, params := r.getRoute(c.Method, c.Req.URL.EscapedPath())
 	if node != nil {
 		c.Params = params
+		c.pattern = node.pattern
 		key := c.Method + "-" + node.pattern
-		handler := r.handlers[key]
-		c.handlers = append(c.handlers, handler)
+		chain, ok := r.chains[key]
+		if !ok {
+			// 处理链取决于请求路径，见 Engine.buildChain
+			chain = append(c.engine.groupMiddlewares(c.Path, true), r.handlers[key])
+		}
+		c.handlers = chain
 	} else {
-		c.handlers = append(c.handlers, func(c *Context) {
+		// 未匹配到路由时，仍然执行请求路径所在分组的中间件
+		c.handlers = append(c.engine.groupMiddlewares(c.Path, false), func(c *Context) {
 			c.String(http.StatusNotFound, "404 NOT FOUND: %s\n", c.Path)
 		})
 	}
@@ -1,6 +1,8 @@
 package gee
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"testing"
 )
@@ -23,6 +25,23 @@ func TestParsePattern(t *testing.T) {
 	}
 }
 
+func TestAddRouteCatchAll(t *testing.T) {
+	r := newRouter()
+	if err := r.addRoute("GET", "/a/*rest/b", nil); err == nil {
+		t.Fatal("/a/*rest/b should be rejected")
+	}
+	if err := r.addRoute("GET", "/a/*rest", nil); err != nil {
+		t.Fatalf("/a/*rest should be accepted: %v", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering an invalid route on a group should panic")
+		}
+	}()
+	New().Group("/a").GET("/*rest/b", func(c *Context) {})
+}
+
 func TestGetRoute(t *testing.T) {
 	r := newTestRouter()
 	n, params := r.getRoute("GET", "/hello/geektutu")
@@ -54,3 +73,58 @@ func TestGetRoute(t *testing.T) {
 		t.Fatal("filepath should be equal to 'css/test.css'")
 	}
 }
+
+func TestGetRouteEscaped(t *testing.T) {
+	r := newTestRouter()
+	n, params := r.getRoute("GET", "/hello/a%20b")
+	if n == nil || n.pattern != "/hello/:name" || params["name"] != "a b" {
+		t.Fatalf("name should be decoded to 'a b', got %q", params["name"])
+	}
+
+	// an encoded slash belongs to the segment, it is not a separator
+	n, params = r.getRoute("GET", "/hello/a%2Fb")
+	if n == nil || n.pattern != "/hello/:name" || params["name"] != "a/b" {
+		t.Fatalf("name should be decoded to 'a/b', got %q", params["name"])
+	}
+
+	_, params = r.getRoute("GET", "/assets/css%2Ftest%20file.css")
+	if params["filepath"] != "css/test file.css" {
+		t.Fatalf("filepath should be decoded to 'css/test file.css', got %q", params["filepath"])
+	}
+}
+
+func TestServeHTTPEscapedParam(t *testing.T) {
+	engine := New()
+	engine.GET("/hello/:name", func(c *Context) {
+		c.String(http.StatusOK, "%s", c.Param("name"))
+	})
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/hello/a%2Fb", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "a/b" {
+		t.Fatalf("expect 'a/b', got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestContextFullPath(t *testing.T) {
+	engine := New()
+	var fullPath string
+	engine.Use(func(c *Context) {
+		c.Next()
+		fullPath = c.FullPath()
+	})
+	engine.GET("/assets/*filepath", func(c *Context) {
+		c.String(http.StatusOK, "%s", c.Param("filepath"))
+	})
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/assets/css/test.css", nil))
+	if w.Body.String() != "css/test.css" || fullPath != "/assets/*filepath" {
+		t.Fatalf("expect the pattern /assets/*filepath, got %q", fullPath)
+	}
+
+	// 未匹配到路由时为空
+	engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/missing", nil))
+	if fullPath != "" {
+		t.Fatalf("expect an empty full path for a 404, got %q", fullPath)
+	}
+}
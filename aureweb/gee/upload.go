@@ -0,0 +1,48 @@
+package gee
+
+import (
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+)
+
+// FormFile returns the first uploaded file of the multipart form key.
+// 超过 32MB 的部分由标准库写入临时文件，不会全部留在内存中
+func (c *Context) FormFile(name string) (*multipart.FileHeader, error) {
+	if c.Req.MultipartForm == nil {
+		if err := c.Req.ParseMultipartForm(defaultMultipartMemory); err != nil {
+			return nil, err
+		}
+	}
+	files := c.Req.MultipartForm.File[name]
+	if len(files) == 0 {
+		return nil, http.ErrMissingFile
+	}
+	return files[0], nil
+}
+
+// SaveUploadedFile saves the uploaded file to dst.
+// 文件内容通过 io.Copy 流式写入 dst，不会整个读入内存；写入失败时删除不完整的 dst
+func (c *Context) SaveUploadedFile(file *multipart.FileHeader, dst string) (err error) {
+	src, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = src.Close() }()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			_ = os.Remove(dst)
+		}
+	}()
+	_, err = io.Copy(out, src)
+	return err
+}
@@ -0,0 +1,64 @@
+package gee
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestSaveUploadedFile(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4<<20/16) // 4MB
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", "big.bin")
+	_, _ = fw.Write(content)
+	_ = mw.Close()
+
+	dst := filepath.Join(t.TempDir(), "big.bin")
+	var allocated uint64
+	engine := New()
+	engine.POST("/upload", func(c *Context) {
+		file, err := c.FormFile("file")
+		if err != nil {
+			c.Fail(http.StatusBadRequest, err.Error())
+			return
+		}
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		if err := c.SaveUploadedFile(file, dst); err != nil {
+			c.Fail(http.StatusInternalServerError, err.Error())
+			return
+		}
+		runtime.ReadMemStats(&after)
+		allocated = after.TotalAlloc - before.TotalAlloc
+		c.String(http.StatusOK, "saved %s", file.Filename)
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expect 200, got %d %q", w.Code, w.Body.String())
+	}
+	saved, err := os.ReadFile(dst)
+	if err != nil || !bytes.Equal(saved, content) {
+		t.Fatalf("saved file differs from the upload: %d bytes, %v", len(saved), err)
+	}
+	// 流式复制只需要一个固定大小的缓冲区，而不是整个文件
+	if allocated > 1<<20 {
+		t.Fatalf("saving a 4MB file should not buffer it, allocated %d bytes", allocated)
+	}
+
+	// 缺少文件时返回 http.ErrMissingFile
+	c := newContext(httptest.NewRecorder(), req)
+	req.MultipartForm = &multipart.Form{}
+	if _, err := c.FormFile("missing"); err != http.ErrMissingFile {
+		t.Fatalf("expect ErrMissingFile, got %v", err)
+	}
+}